@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	aclFile = "acl.conf"
+
+	// aclPollInterval is how often serve checks acl.conf for changes.
+	aclPollInterval = 2 * time.Second
+)
+
+// aclRule is one line of acl.conf.
+type aclRule struct {
+	sender  string   // node key, name from paired_senders, or "*"
+	push    bool     // may push pages and assets
+	maxSize int64    // largest file in bytes, 0 for no limit beyond -max-size
+	types   []string // allowed extensions without the dot, nil for any
+	delete  string   // "no", "own" or "all"
+}
+
+// ACL is the receiver's per-sender policy, read from <data>/acl.conf. Each
+// line is a rule, and the first one matching the sender applies:
+//
+//	# sender     push  max-mb  types          delete
+//	office-pc    yes   -       *              all
+//	3f9a0c...    yes   50      html,png,css   own
+//	*            no    -       *              no
+//
+// Senders are matched by the node key their requests are signed with,
+// given in full or by the name it was paired under, which must be unique
+// in paired_senders. "*" matches everyone,
+// including older clients that don't sign requests. Senders that match no
+// rule may neither push nor delete. Without acl.conf, anyone who passes
+// authentication may do both; removing it while serve runs keeps the last
+// policy until restart.
+type ACL struct {
+	path   string
+	paired *TrustedKeys
+
+	mu      sync.Mutex
+	rules   []aclRule
+	present bool
+	missing bool // acl.conf was removed after being loaded
+	modTime time.Time
+	size    int64
+}
+
+func LoadACL(dataDir string, paired *TrustedKeys) (*ACL, error) {
+	a := &ACL{path: filepath.Join(dataDir, aclFile), paired: paired}
+	if _, err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload reads acl.conf again if it changed since the last read, and
+// reports whether the policy changed. On error the previous policy stays in
+// effect, and the error is only reported once per change to the file.
+func (a *ACL) reload() (bool, error) {
+	info, err := os.Stat(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// A policy that was loaded stays in effect: losing acl.conf, say
+		// to an editor saving it, must not open the receiver to everyone.
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if !a.present || a.missing {
+			return false, nil
+		}
+		a.missing = true
+		a.modTime, a.size = time.Time{}, 0
+		return false, fmt.Errorf("%s was removed", a.path)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	a.mu.Lock()
+	a.missing = false
+	unchanged := info.ModTime().Equal(a.modTime) && info.Size() == a.size
+	a.modTime, a.size = info.ModTime(), info.Size()
+	a.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	rules, err := parseACL(f, a.path)
+	if err != nil {
+		return false, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules, a.present = rules, true
+	return true, nil
+}
+
+// watch reloads acl.conf when it changes, until ctx is done.
+func (a *ACL) watch(ctx context.Context) {
+	ticker := time.NewTicker(aclPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := a.reload()
+		switch {
+		case err != nil:
+			log.Printf("Reload %s: %v (keeping the previous policy)", aclFile, err)
+		case changed:
+			a.logPolicy()
+		}
+	}
+}
+
+func (a *ACL) logPolicy() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.present {
+		log.Printf("Access control: %d rule(s) from %s", len(a.rules), a.path)
+	} else {
+		log.Printf("Access control: no %s, accepting all senders", aclFile)
+	}
+}
+
+func parseACL(r io.Reader, path string) ([]aclRule, error) {
+	var rules []aclRule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%s:%d: want \"sender push max-mb types delete\"", path, n)
+		}
+		rule, err := parseACLRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func parseACLRule(fields []string) (aclRule, error) {
+	rule := aclRule{sender: fields[0]}
+	if validNodeKey(rule.sender) {
+		rule.sender = strings.ToLower(rule.sender)
+	}
+
+	switch fields[1] {
+	case "yes":
+		rule.push = true
+	case "no":
+	default:
+		return aclRule{}, fmt.Errorf("push must be yes or no, not %q", fields[1])
+	}
+
+	if fields[2] != "-" {
+		mb, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || mb <= 0 {
+			return aclRule{}, fmt.Errorf("max-mb must be a positive number of MB or -, not %q", fields[2])
+		}
+		rule.maxSize = mb << 20
+	}
+
+	if fields[3] != "*" {
+		for _, ext := range strings.Split(fields[3], ",") {
+			ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+			if ext != "" {
+				rule.types = append(rule.types, ext)
+			}
+		}
+		if len(rule.types) == 0 {
+			return aclRule{}, fmt.Errorf("types must be extensions like html,png or *, not %q", fields[3])
+		}
+	}
+
+	switch fields[4] {
+	case "no", "own", "all":
+		rule.delete = fields[4]
+	default:
+		return aclRule{}, fmt.Errorf("delete must be no, own or all, not %q", fields[4])
+	}
+	return rule, nil
+}
+
+// senderPolicy is what the ACL allows the sender of one request.
+type senderPolicy struct {
+	key  string   // verified node key, empty if unsigned
+	who  string   // how errors refer to the sender
+	rule *aclRule // nil if no rule matches
+	open bool     // there is no acl.conf
+}
+
+// policy returns the rule for the sender of r, which must have gone
+// through SenderAuth.Identify.
+func (a *ACL) policy(r *http.Request) senderPolicy {
+	key := senderKey(r)
+	p := senderPolicy{key: key, who: "unsigned sender"}
+	if key != "" {
+		if name := a.paired.Name(key); name != "" {
+			p.who = fmt.Sprintf("sender %q", name)
+		} else {
+			p.who = "sender " + key[:16]
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.present {
+		p.open = true
+		return p
+	}
+	for i := range a.rules {
+		if a.rules[i].matches(key, a.paired) {
+			rule := a.rules[i]
+			p.rule = &rule
+			break
+		}
+	}
+	return p
+}
+
+func (rule *aclRule) matches(key string, paired *TrustedKeys) bool {
+	switch {
+	case rule.sender == "*":
+		return true
+	case key == "":
+		return false
+	case rule.sender == key:
+		return true
+	case validNodeKey(rule.sender):
+		return false
+	default:
+		// A name only stands for a sender if exactly one key was paired
+		// under it.
+		keys := paired.Named(rule.sender)
+		return len(keys) == 1 && keys[0] == key
+	}
+}
+
+func (p senderPolicy) deny(format string, args ...any) error {
+	return fmt.Errorf("forbidden: %s %s", p.who, fmt.Sprintf(format, args...))
+}
+
+// push checks that the sender may push at all.
+func (p senderPolicy) push() error {
+	switch {
+	case p.open:
+		return nil
+	case p.rule == nil:
+		return p.deny("is not allowed to push (no rule in %s)", aclFile)
+	case !p.rule.push:
+		return p.deny("is not allowed to push")
+	}
+	return nil
+}
+
+// file checks that the sender may push a file with this name and size. A
+// negative size isn't checked, for when it isn't known yet.
+func (p senderPolicy) file(name string, size int64) error {
+	if err := p.push(); err != nil || p.open {
+		return err
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	if p.rule.types != nil && !slices.Contains(p.rule.types, ext) {
+		return p.deny("may only push %s files, not %q", strings.Join(p.rule.types, ", "), name)
+	}
+	if p.rule.maxSize > 0 && size > p.rule.maxSize {
+		return p.deny("may only push files up to %d MB, %q is larger", p.rule.maxSize>>20, name)
+	}
+	return nil
+}
+
+// limitReader stops reading r one byte past the sender's size limit, so an
+// oversized file is caught by file without reading all of it.
+func (p senderPolicy) limitReader(r io.Reader) io.Reader {
+	if p.rule == nil || p.rule.maxSize == 0 {
+		return r
+	}
+	return io.LimitReader(r, p.rule.maxSize+1)
+}
+
+// delete checks that the sender may delete entry. The web UI on the
+// receiver itself may always delete.
+func (p senderPolicy) delete(r *http.Request, entry *FileEntry) error {
+	if p.open || (p.key == "" && isLocalUI(r)) {
+		return nil
+	}
+	if p.rule == nil {
+		return p.deny("is not allowed to delete files (no rule in %s)", aclFile)
+	}
+	switch p.rule.delete {
+	case "all":
+		return nil
+	case "own":
+		if p.key != "" && entry.SenderKey == p.key {
+			return nil
+		}
+		return p.deny("may only delete files it sent")
+	}
+	return p.deny("is not allowed to delete files")
+}
+
+// restore checks that the sender may restore an old revision of entry:
+// one it may delete, or one it sent and may push again.
+func (p senderPolicy) restore(r *http.Request, entry *FileEntry) error {
+	if p.delete(r, entry) == nil {
+		return nil
+	}
+	if p.push() == nil && p.key != "" && entry.SenderKey == p.key {
+		return nil
+	}
+	return p.deny("may not restore %q", entry.Filename)
+}
+
+// aclError answers a request the ACL refused.
+func aclError(w http.ResponseWriter, err error) {
+	jsonError(w, err.Error(), http.StatusForbidden)
+}
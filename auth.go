@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerTimestamp   = "X-Distrib-Timestamp"
+	headerNonce       = "X-Distrib-Nonce"
+	headerContentHash = "X-Distrib-Content-SHA256"
+	headerSignature   = "X-Distrib-Signature"
+
+	headerSenderKey       = "X-Distrib-Sender-Key"
+	headerSenderSignature = "X-Distrib-Sender-Signature"
+
+	// headerLocalUI marks requests from the web UI. Browsers only send a
+	// custom header to another site after a CORS preflight, which distrib
+	// never grants, so a page elsewhere can't add it.
+	headerLocalUI = "X-Distrib-UI"
+
+	keyFileName = "secret.key"
+
+	// authMaxSkew bounds how old (or how far in the future) a signed request
+	// may be. Nonces are remembered for twice this long to reject replays.
+	authMaxSkew = 5 * time.Minute
+)
+
+// Authenticator signs and verifies requests with a pre-shared key. Each
+// request carries a timestamp, a random nonce and the SHA256 of its body,
+// all covered by an HMAC-SHA256 signature.
+type Authenticator struct {
+	key    []byte
+	nonces nonceCache
+}
+
+func NewAuthenticator(key []byte) *Authenticator {
+	if len(key) == 0 {
+		return nil
+	}
+	return &Authenticator{key: key}
+}
+
+// loadKey returns the shared key from the -key flag, falling back to
+// secret.key in the data directory. A nil key means authentication is off.
+func loadKey(flagValue, dataDir string) ([]byte, error) {
+	if flagValue != "" {
+		return []byte(flagValue), nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(dataDir, keyFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", filepath.Join(dataDir, keyFileName))
+	}
+	return key, nil
+}
+
+// Sign adds authentication headers to req. bodyHash is the hex SHA256 of
+// the request body.
+func (a *Authenticator) Sign(req *http.Request, bodyHash string) {
+	if a == nil {
+		return
+	}
+	ts, n := stampRequest(req, bodyHash)
+	req.Header.Set(headerSignature, a.signature(req.Method, req.URL.RequestURI(), ts, n, bodyHash))
+}
+
+// stampRequest sets the timestamp, nonce and body hash headers that both
+// kinds of signature cover, unless an earlier signature already did.
+func stampRequest(req *http.Request, bodyHash string) (ts, nonce string) {
+	if ts = req.Header.Get(headerTimestamp); ts != "" {
+		return ts, req.Header.Get(headerNonce)
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+	ts = strconv.FormatInt(time.Now().Unix(), 10)
+	nonce = hex.EncodeToString(b[:])
+
+	req.Header.Set(headerTimestamp, ts)
+	req.Header.Set(headerNonce, nonce)
+	req.Header.Set(headerContentHash, bodyHash)
+	return ts, nonce
+}
+
+func (a *Authenticator) signature(method, uri, ts, nonce, bodyHash string) string {
+	mac := hmac.New(sha256.New, a.key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, ts, nonce, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature headers of r and wraps r.Body so that reading
+// it to the end fails if the body doesn't match the signed hash. Handlers
+// must call finishBody before acting on the request.
+func (a *Authenticator) Verify(r *http.Request) error {
+	ts := r.Header.Get(headerTimestamp)
+	nonce := r.Header.Get(headerNonce)
+	bodyHash := r.Header.Get(headerContentHash)
+	sig := r.Header.Get(headerSignature)
+	if ts == "" || nonce == "" || bodyHash == "" || sig == "" {
+		return errors.New("missing signature")
+	}
+
+	sent, err := checkTimestamp(ts)
+	if err != nil {
+		return err
+	}
+
+	want := a.signature(r.Method, r.URL.RequestURI(), ts, nonce, bodyHash)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return errors.New("invalid signature")
+	}
+
+	if !a.nonces.use(nonce, sent) {
+		return errors.New("replayed request")
+	}
+
+	return verifyBody(r, bodyHash)
+}
+
+func checkTimestamp(ts string) (time.Time, error) {
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("invalid timestamp")
+	}
+	sent := time.Unix(unix, 0)
+	if skew := time.Since(sent); skew > authMaxSkew || skew < -authMaxSkew {
+		return time.Time{}, errors.New("request timestamp outside allowed window")
+	}
+	return sent, nil
+}
+
+// verifyBody wraps r.Body so that reading it to the end fails unless it
+// hashes to bodyHash.
+func verifyBody(r *http.Request, bodyHash string) error {
+	sum, err := hex.DecodeString(bodyHash)
+	if err != nil || len(sum) != sha256.Size {
+		return errors.New("invalid body hash")
+	}
+	r.Body = &verifiedBody{ReadCloser: r.Body, hash: sha256.New(), want: sum}
+	return nil
+}
+
+var errBodyMismatch = errors.New("body does not match signature")
+
+// verifiedBody hashes a request body as it is read and reports
+// errBodyMismatch instead of io.EOF if the hash is wrong.
+type verifiedBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	want []byte
+}
+
+func (b *verifiedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(b.hash.Sum(nil), b.want) {
+		return n, errBodyMismatch
+	}
+	return n, err
+}
+
+// finishBody reads whatever is left of the request body. For signed
+// requests this is where a tampered body is detected, so it must succeed
+// before anything is committed.
+func finishBody(r *http.Request) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	return err
+}
+
+// nonceCache remembers the nonces of recent signed requests.
+type nonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// use records nonce and reports whether it was unused.
+func (nc *nonceCache) use(nonce string, sent time.Time) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	now := time.Now()
+	for n, t := range nc.seen {
+		if now.Sub(t) > 2*authMaxSkew {
+			delete(nc.seen, n)
+		}
+	}
+
+	if _, ok := nc.seen[nonce]; ok {
+		return false
+	}
+	if nc.seen == nil {
+		nc.seen = make(map[string]time.Time)
+	}
+	nc.seen[nonce] = sent
+	return true
+}
+
+// Require wraps next so that it only runs for correctly signed requests.
+// With allowLocal, requests from the local web UI (see isLocalUI) are let
+// through unsigned. A nil Authenticator disables the check.
+func (a *Authenticator) Require(next http.HandlerFunc, allowLocal bool) http.HandlerFunc {
+	if a == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if allowLocal && isLocalUI(r) {
+			next(w, r)
+			return
+		}
+		if err := a.Verify(r); err != nil {
+			jsonError(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// signSender adds the sender's node key and a signature by it over the same
+// fields the shared-key signature covers. Receivers identify the sender by
+// this key, and in -strict mode only accept paired ones.
+func signSender(req *http.Request, key ed25519.PrivateKey, bodyHash string) {
+	if key == nil {
+		return
+	}
+	ts, n := stampRequest(req, bodyHash)
+	sig := ed25519.Sign(key, senderSignedBytes(req.Method, req.URL.RequestURI(), ts, n, bodyHash))
+	req.Header.Set(headerSenderKey, publicKeyHex(key))
+	req.Header.Set(headerSenderSignature, hex.EncodeToString(sig))
+}
+
+func senderSignedBytes(method, uri, ts, nonce, bodyHash string) []byte {
+	return fmt.Appendf(nil, "distrib-request-v1\n%s\n%s\n%s\n%s\n%s", method, uri, ts, nonce, bodyHash)
+}
+
+// SenderAuth identifies senders by the node key their requests are signed
+// with. In strict mode, it only admits paired senders.
+type SenderAuth struct {
+	paired *TrustedKeys
+	self   string // the receiver's own key, for pushes from this machine
+	strict bool
+	nonces nonceCache
+}
+
+func NewSenderAuth(paired *TrustedKeys, self ed25519.PrivateKey, strict bool) *SenderAuth {
+	return &SenderAuth{paired: paired, self: publicKeyHex(self), strict: strict}
+}
+
+// Verify checks that r is signed by a sender's node key (a paired one, in
+// strict mode) and returns the key. Like Authenticator.Verify, it wraps
+// r.Body to check the signed hash.
+func (s *SenderAuth) Verify(r *http.Request) (string, error) {
+	ts := r.Header.Get(headerTimestamp)
+	nonce := r.Header.Get(headerNonce)
+	bodyHash := r.Header.Get(headerContentHash)
+	key := strings.ToLower(r.Header.Get(headerSenderKey))
+	sig := r.Header.Get(headerSenderSignature)
+	if ts == "" || nonce == "" || bodyHash == "" || key == "" || sig == "" {
+		return "", errors.New("missing sender signature")
+	}
+	if s.strict && key != s.self && !s.paired.Has(key) {
+		return "", errors.New("sender is not paired")
+	}
+
+	sent, err := checkTimestamp(ts)
+	if err != nil {
+		return "", err
+	}
+
+	pub, err := hex.DecodeString(key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return "", errors.New("invalid sender key")
+	}
+	rawSig, err := hex.DecodeString(sig)
+	if err != nil || !ed25519.Verify(pub, senderSignedBytes(r.Method, r.URL.RequestURI(), ts, nonce, bodyHash), rawSig) {
+		return "", errors.New("invalid sender signature")
+	}
+
+	if !s.nonces.use(nonce, sent) {
+		return "", errors.New("replayed request")
+	}
+
+	return key, verifyBody(r, bodyHash)
+}
+
+type senderKeyContext struct{}
+
+// Identify wraps next so that signed requests carry the sender's verified
+// key, which senderKey returns. Requests with a bad signature are refused.
+// Unsigned requests, from clients that predate node keys, get through
+// without a key unless strict mode requires a paired sender. With
+// allowLocal, unsigned requests from the local web UI (see isLocalUI) get
+// through even in strict mode.
+func (s *SenderAuth) Identify(next http.HandlerFunc, allowLocal bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		unsigned := r.Header.Get(headerSenderKey) == ""
+		if unsigned && (!s.strict || (allowLocal && isLocalUI(r))) {
+			next(w, r)
+			return
+		}
+		key, err := s.Verify(r)
+		if err != nil {
+			jsonError(w, "forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), senderKeyContext{}, key)))
+	}
+}
+
+// senderKey returns the node key r was verified to be signed with, or ""
+// for an unsigned request.
+func senderKey(r *http.Request) string {
+	key, _ := r.Context().Value(senderKeyContext{}).(string)
+	return key
+}
+
+// isLocalUI reports whether r comes from the web UI on this machine. Being
+// sent from the loopback interface isn't enough, since a browser there
+// sends requests for any site it visits: r must also carry headerLocalUI,
+// be addressed to a loopback name rather than one rebound to 127.0.0.1,
+// and not come from a page on another origin.
+func isLocalUI(r *http.Request) bool {
+	if !isLoopback(r.RemoteAddr) || r.Header.Get(headerLocalUI) == "" || !isLoopbackHost(r.Host) {
+		return false
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return false
+		}
+	}
+	return true
+}
+
+// isLoopbackHost reports whether host, from a Host header or URL, names
+// this machine: localhost or a loopback address, with or without a port.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
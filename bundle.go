@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxRefLen bounds how much of one reference is kept while scanning; longer
+// values (inline data: URLs, mostly) are skipped without being buffered.
+const maxRefLen = 4096
+
+// findLocalAssets scans an HTML page for relative src/href/url() references
+// and returns the ones that exist on disk next to the page. References that
+// look local but can't be read are returned in missing.
+func findLocalAssets(htmlPath string) (assets []assetData, missing []string, err error) {
+	f, err := os.Open(htmlPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	refs, err := scanRefs(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	baseDir := filepath.Dir(htmlPath)
+	self := filepath.Base(htmlPath)
+	seen := make(map[string]bool)
+
+	for _, ref := range refs {
+		rel, ok := localRef(ref)
+		if !ok || rel == self || seen[rel] {
+			continue
+		}
+		seen[rel] = true
+
+		full := filepath.Join(baseDir, filepath.FromSlash(rel))
+		info, err := os.Stat(full)
+		if err != nil || !info.Mode().IsRegular() {
+			missing = append(missing, rel)
+			continue
+		}
+		assets = append(assets, assetData{name: rel, path: full})
+	}
+
+	return assets, missing, nil
+}
+
+// scanRefs reads an HTML page and returns the values of its src="...",
+// href="..." and url(...) references. It reads r a byte at a time through a
+// bufio.Reader, so only the reference being read is held in memory.
+func scanRefs(r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+	var refs []string
+	var word []byte // the last few letters read, lowercased
+
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return refs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isASCIILetter(c) {
+			if len(word) == len("href") {
+				word = append(word[:0], word[1:]...)
+			}
+			word = append(word, c|0x20)
+			continue
+		}
+
+		switch {
+		case c == '(' && bytes.HasSuffix(word, []byte("url")):
+			skipSpace(br)
+			if q, err := br.Peek(1); err == nil && (q[0] == '"' || q[0] == '\'') {
+				br.ReadByte()
+			}
+			if ref, ok := readRef(br, `"')`); ok {
+				refs = append(refs, strings.TrimSpace(ref))
+			}
+		case bytes.HasSuffix(word, []byte("src")) || bytes.HasSuffix(word, []byte("href")):
+			br.UnreadByte()
+			skipSpace(br)
+			if c, err := br.ReadByte(); err != nil || c != '=' {
+				break
+			}
+			skipSpace(br)
+			if q, err := br.ReadByte(); err != nil || (q != '"' && q != '\'') {
+				break
+			}
+			if ref, ok := readRef(br, `"'`); ok {
+				refs = append(refs, ref)
+			}
+		}
+		word = word[:0]
+	}
+}
+
+// readRef reads up to the next byte in stop, which it consumes. It reports
+// false for empty or overlong values and for ones cut off by the end of r.
+func readRef(br *bufio.Reader, stop string) (string, bool) {
+	var ref []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", false
+		}
+		if strings.IndexByte(stop, c) >= 0 {
+			return string(ref), len(ref) > 0 && len(ref) <= maxRefLen
+		}
+		if len(ref) <= maxRefLen {
+			ref = append(ref, c)
+		}
+	}
+}
+
+func skipSpace(br *bufio.Reader) {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != '\f' {
+			br.UnreadByte()
+			return
+		}
+	}
+}
+
+func isASCIILetter(c byte) bool {
+	return 'a' <= c|0x20 && c|0x20 <= 'z'
+}
+
+// localRef reports whether ref points at a file relative to the page and
+// returns it as a clean slash-separated path.
+func localRef(ref string) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "/") {
+		return "", false
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+
+	// Skip references that climb above the page's directory; the receiver
+	// only serves files from inside the entry's content directory.
+	rel := path.Clean(u.Path)
+	if !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", false
+	}
+
+	return rel, true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// checkRequest asks a receiver what it already has of a page and its assets.
+type checkRequest struct {
+	Filename string            `json:"filename"`
+	Sender   string            `json:"sender"`
+	SHA256   string            `json:"sha256,omitempty"`
+	Assets   map[string]string `json:"assets,omitempty"` // path -> SHA256
+}
+
+type checkResponse struct {
+	ID        string   `json:"id,omitempty"`
+	UpToDate  bool     `json:"up_to_date"`          // the page has the requested SHA256
+	Encrypted bool     `json:"encrypted,omitempty"` // the stored page was pushed with -encrypt
+	Missing   []string `json:"missing"`             // assets that are absent or differ
+}
+
+// handleCheck compares a sender's page and assets with what is stored, so
+// the client can skip uploading identical bytes.
+func handleCheck(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req checkRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			jsonError(w, "parse request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Filename == "" {
+			jsonError(w, "missing filename", http.StatusBadRequest)
+			return
+		}
+		if req.Sender == "" {
+			req.Sender = "unknown"
+		}
+
+		resp := checkResponse{Missing: []string{}}
+		entry := store.FindByFilenameAndSender(req.Filename, req.Sender, senderKey(r))
+		if entry != nil {
+			resp.ID = entry.ID
+			resp.UpToDate = req.SHA256 != "" && strings.EqualFold(entry.SHA256, req.SHA256)
+			resp.Encrypted = entry.Encrypted
+		}
+		for name, sha := range req.Assets {
+			if entry != nil && strings.EqualFold(entry.Assets[name], sha) {
+				continue
+			}
+			resp.Missing = append(resp.Missing, name)
+		}
+		slices.Sort(resp.Missing)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// checkPeer asks addr which parts of a push it already has. It returns nil
+// without an error when the receiver predates the check endpoint, in which
+// case everything should be sent.
+func checkPeer(c *client, addr, filename, sender, sha string, assets []assetData) (*checkResponse, error) {
+	req := checkRequest{Filename: filename, Sender: sender, SHA256: sha}
+	if len(assets) > 0 {
+		req.Assets = make(map[string]string, len(assets))
+		for _, a := range assets {
+			req.Assets[a.name] = a.sha256
+		}
+	}
+
+	var resp checkResponse
+	err := c.doJSON(http.MethodPost, addr, "/check", req, &resp)
+	var se *statusError
+	if errors.As(err, &se) && (se.Code == http.StatusNotFound || se.Code == http.StatusMethodNotAllowed) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("check: %w", err)
+	}
+	return &resp, nil
+}
+
+// missing returns the assets the receiver reported as absent or different.
+func (r *checkResponse) missing(assets []assetData) []assetData {
+	var out []assetData
+	for _, a := range assets {
+		if slices.Contains(r.Missing, a.name) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// hashAssets records the size and SHA256 of each asset's file.
+func hashAssets(assets []assetData) error {
+	for i := range assets {
+		size, sha, err := hashFile(assets[i].path)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", assets[i].path, err)
+		}
+		assets[i].size, assets[i].sha256 = size, sha
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var validUploadID = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+// chunkedUploadTTL is how long an unfinished chunked upload is kept.
+const chunkedUploadTTL = 24 * time.Hour
+
+// ChunkedUpload is the state of a resumable upload. Data is appended to
+// {id}.part in the uploads directory; the state lives in {id}.json.
+type ChunkedUpload struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Sender    string    `json:"sender"`
+	SenderKey string    `json:"sender_key,omitempty"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Encrypted bool      `json:"encrypted,omitempty"` // declared by the sender
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChunkedUploads manages resumable uploads that arrive in pieces:
+// initiate, PUT chunks at increasing offsets, then finalize.
+type ChunkedUploads struct {
+	dir string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func NewChunkedUploads(dataDir string) (*ChunkedUploads, error) {
+	dir := filepath.Join(dataDir, "uploads")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create uploads dir: %w", err)
+	}
+	u := &ChunkedUploads{dir: dir, locks: make(map[string]*sync.Mutex)}
+	u.expire()
+	return u, nil
+}
+
+func (u *ChunkedUploads) partPath(id string) string {
+	return filepath.Join(u.dir, id+".part")
+}
+
+func (u *ChunkedUploads) statePath(id string) string {
+	return filepath.Join(u.dir, id+".json")
+}
+
+// lock serializes operations on a single upload.
+func (u *ChunkedUploads) lock(id string) func() {
+	u.mu.Lock()
+	l, ok := u.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		u.locks[id] = l
+	}
+	u.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// Create starts a new upload, or returns an unfinished one for the same
+// file so a client that lost its state can still resume.
+func (u *ChunkedUploads) Create(filename, sender, senderKey string, size int64, sha string, encrypted bool) (*ChunkedUpload, error) {
+	u.expire()
+
+	if existing := u.find(filename, sender, senderKey, size, sha, encrypted); existing != nil {
+		return existing, nil
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+	up := &ChunkedUpload{
+		ID:        hex.EncodeToString(b[:]),
+		Filename:  filename,
+		Sender:    sender,
+		SenderKey: senderKey,
+		Size:      size,
+		SHA256:    sha,
+		Encrypted: encrypted,
+		CreatedAt: time.Now(),
+	}
+
+	if err := os.WriteFile(u.partPath(up.ID), nil, 0644); err != nil {
+		return nil, fmt.Errorf("create part file: %w", err)
+	}
+	data, err := json.MarshalIndent(up, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal upload state: %w", err)
+	}
+	if err := writeFileAtomic(u.statePath(up.ID), data, 0644); err != nil {
+		return nil, fmt.Errorf("write upload state: %w", err)
+	}
+	return up, nil
+}
+
+func (u *ChunkedUploads) Get(id string) (*ChunkedUpload, error) {
+	if !validUploadID.MatchString(id) {
+		return nil, fmt.Errorf("invalid upload ID")
+	}
+	data, err := os.ReadFile(u.statePath(id))
+	if err != nil {
+		return nil, fmt.Errorf("read upload state: %w", err)
+	}
+	var up ChunkedUpload
+	if err := json.Unmarshal(data, &up); err != nil {
+		return nil, fmt.Errorf("parse upload state: %w", err)
+	}
+	return &up, nil
+}
+
+// Offset returns how many bytes of the upload have been received.
+func (u *ChunkedUploads) Offset(id string) (int64, error) {
+	info, err := os.Stat(u.partPath(id))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (u *ChunkedUploads) Remove(id string) {
+	os.Remove(u.partPath(id))
+	os.Remove(u.statePath(id))
+	u.mu.Lock()
+	delete(u.locks, id)
+	u.mu.Unlock()
+}
+
+func (u *ChunkedUploads) find(filename, sender, senderKey string, size int64, sha string, encrypted bool) *ChunkedUpload {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		up, err := u.Get(id)
+		if err != nil {
+			continue
+		}
+		if up.Filename == filename && up.Sender == sender && up.SenderKey == senderKey && up.Size == size && up.SHA256 == sha && up.Encrypted == encrypted {
+			return up
+		}
+	}
+	return nil
+}
+
+// expire removes uploads that were started more than chunkedUploadTTL ago.
+func (u *ChunkedUploads) expire() {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		up, err := u.Get(id)
+		if err != nil || time.Since(up.CreatedAt) > chunkedUploadTTL {
+			log.Printf("Removing expired upload %s", id)
+			u.Remove(id)
+		}
+	}
+}
+
+func handleUploadCreate(uploads *ChunkedUploads, acl *ACL, maxSize int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy := acl.policy(r)
+		if err := policy.push(); err != nil {
+			aclError(w, err)
+			return
+		}
+
+		var req struct {
+			Filename  string `json:"filename"`
+			Sender    string `json:"sender"`
+			Size      int64  `json:"size"`
+			SHA256    string `json:"sha256"`
+			Encrypted bool   `json:"encrypted"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+			jsonError(w, "parse request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := finishBody(r); err != nil {
+			uploadError(w, "read body", err)
+			return
+		}
+
+		req.Filename = filepath.Base(req.Filename)
+		if req.Filename == "." || req.Filename == string(filepath.Separator) || req.Size < 0 {
+			jsonError(w, "invalid filename or size", http.StatusBadRequest)
+			return
+		}
+		if sum, err := hex.DecodeString(req.SHA256); err != nil || len(sum) != 32 {
+			jsonError(w, "invalid sha256", http.StatusBadRequest)
+			return
+		}
+		if req.Size > maxSize {
+			jsonError(w, fmt.Sprintf("upload exceeds maximum size of %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := policy.file(req.Filename, req.Size); err != nil {
+			aclError(w, err)
+			return
+		}
+		if req.Sender == "" {
+			req.Sender = "unknown"
+		}
+
+		up, err := uploads.Create(req.Filename, req.Sender, senderKey(r), req.Size, strings.ToLower(req.SHA256), req.Encrypted)
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		offset, err := uploads.Offset(up.ID)
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": up.ID, "offset": offset, "size": up.Size})
+	}
+}
+
+func handleUploadStatus(uploads *ChunkedUploads) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("uid")
+		up, err := uploads.Get(id)
+		if err != nil {
+			jsonError(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		offset, err := uploads.Offset(id)
+		if err != nil {
+			jsonError(w, "upload not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": up.ID, "offset": offset, "size": up.Size})
+	}
+}
+
+// handleUploadChunk appends a chunk at the offset given in the query. The
+// offset must match what has been received so far; otherwise the request
+// fails with 409 and the current offset, so the client can pick up from
+// there.
+func handleUploadChunk(uploads *ChunkedUploads) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("uid")
+		up, err := uploads.Get(id)
+		if err != nil {
+			jsonError(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		if up.SenderKey != senderKey(r) {
+			jsonError(w, "forbidden: upload was started by another sender", http.StatusForbidden)
+			return
+		}
+
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil {
+			jsonError(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+
+		unlock := uploads.lock(id)
+		defer unlock()
+
+		current, err := uploads.Offset(id)
+		if err != nil {
+			jsonError(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		if offset != current {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]any{"error": "offset mismatch", "offset": current})
+			return
+		}
+
+		f, err := os.OpenFile(uploads.partPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		// Whatever arrives before a dropped connection is kept; the client
+		// asks for the offset and resumes from there.
+		r.Body = http.MaxBytesReader(w, r.Body, up.Size-current)
+		n, err := io.Copy(f, r.Body)
+		if err == nil {
+			err = finishBody(r)
+		}
+		if err != nil {
+			if errors.Is(err, errBodyMismatch) {
+				f.Truncate(current)
+			}
+			uploadError(w, "write chunk", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": id, "offset": current + n})
+	}
+}
+
+// handleUploadFinalize checks the assembled file against the declared size
+// and SHA256 and moves it into the store like a regular push. The ACL is
+// checked again, in case it changed since the upload started.
+func handleUploadFinalize(uploads *ChunkedUploads, store *Store, broker *SSEBroker, acl *ACL) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("uid")
+		up, err := uploads.Get(id)
+		if err != nil {
+			jsonError(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		if up.SenderKey != senderKey(r) {
+			jsonError(w, "forbidden: upload was started by another sender", http.StatusForbidden)
+			return
+		}
+		if err := acl.policy(r).file(up.Filename, up.Size); err != nil {
+			aclError(w, err)
+			return
+		}
+
+		unlock := uploads.lock(id)
+		defer unlock()
+
+		upload, err := store.AdoptUpload(uploads.partPath(id))
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer upload.Discard()
+
+		if upload.Size() != up.Size {
+			jsonError(w, fmt.Sprintf("incomplete upload: have %d of %d bytes", upload.Size(), up.Size), http.StatusConflict)
+			return
+		}
+		if upload.SHA256() != up.SHA256 {
+			uploads.Remove(id)
+			jsonError(w, "checksum mismatch, upload discarded", http.StatusUnprocessableEntity)
+			return
+		}
+
+		entry, updated, err := store.Save(up.Filename, up.Sender, up.SenderKey, up.Encrypted, upload)
+		if err != nil {
+			jsonError(w, "save file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		uploads.Remove(id)
+
+		announceEntry(broker, entry, updated)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"ok": true, "id": entry.ID})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// client sends requests to receivers over TLS, pinning each receiver's
+// certificate on first use, signing requests with its node key and, when a
+// shared key is set, with that too.
+type client struct {
+	http     *http.Client
+	auth     *Authenticator
+	node     ed25519.PrivateKey
+	known    *KnownPeers
+	insecure bool // plain HTTP, for receivers that predate TLS
+
+	// timeout cancels a request when no body bytes have been sent and no
+	// response has arrived for that long, so a hung receiver doesn't stall
+	// a push while a slow but steady upload still completes.
+	timeout  time.Duration
+	progress func(n int64) // called with the body bytes sent
+}
+
+const defaultRequestTimeout = 30 * time.Second
+
+var errRequestTimeout = errors.New("request timed out")
+
+// loadClient builds a client from the data directory and command-line flags.
+func loadClient(dataDir, keyFlag string, insecure bool) (*client, error) {
+	key, err := loadKey(keyFlag, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	known, err := LoadKnownPeers(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := loadOrCreateNodeKey(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{auth: NewAuthenticator(key), node: node, known: known, insecure: insecure, timeout: defaultRequestTimeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialTLSContext = c.dialTLS
+	c.http = &http.Client{Transport: transport}
+	return c, nil
+}
+
+func (c *client) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &tls.Dialer{Config: &tls.Config{
+		// Receivers use self-signed certificates; VerifyConnection checks
+		// the fingerprint against known_peers instead of a CA chain.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return c.known.Check(addr, cs)
+		},
+	}}
+	return d.DialContext(ctx, network, addr)
+}
+
+// withProgress returns a copy of c that reports the body bytes it sends.
+func (c *client) withProgress(fn func(n int64)) *client {
+	cc := *c
+	cc.progress = fn
+	return &cc
+}
+
+// addPeers records fingerprints announced during discovery.
+func (c *client) addPeers(peers []Peer) {
+	for _, p := range peers {
+		c.known.Advertise(p.Addr, p.Fingerprint)
+	}
+}
+
+func (c *client) url(addr, path string) string {
+	scheme := "https"
+	if c.insecure {
+		scheme = "http"
+	}
+	path, query, _ := strings.Cut(path, "?")
+	u := url.URL{Scheme: scheme, Host: addr, Path: path, RawQuery: query}
+	return u.String()
+}
+
+// postMultipart streams the multipart body written by build to addr and
+// decodes the JSON response into result. The body is produced on the fly
+// through a pipe. Signatures need the body's hash up front, so build runs
+// twice and must write the same content both times.
+func (c *client) postMultipart(addr, path string, build func(*multipart.Writer) error, result any) error {
+	tmpl := multipart.NewWriter(io.Discard)
+	write := func(w io.Writer) error {
+		mw := multipart.NewWriter(w)
+		mw.SetBoundary(tmpl.Boundary())
+		if err := build(mw); err != nil {
+			return err
+		}
+		return mw.Close()
+	}
+
+	h := sha256.New()
+	if err := write(h); err != nil {
+		return err
+	}
+	bodyHash := hex.EncodeToString(h.Sum(nil))
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+
+	return c.do(http.MethodPost, addr, path, tmpl.FormDataContentType(), pr, bodyHash, result)
+}
+
+// doJSON sends payload (if any) as JSON and decodes the JSON response.
+func (c *client) doJSON(method, addr, path string, payload, result any) error {
+	var body []byte
+	contentType := ""
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		contentType = "application/json"
+	}
+	return c.do(method, addr, path, contentType, bytes.NewReader(body), sha256Hex(body), result)
+}
+
+// do sends a request to addr and decodes the JSON response into result.
+// bodyHash is the hex SHA256 of body, used to sign the request.
+func (c *client) do(method, addr, path, contentType string, body io.Reader, bodyHash string, result any) error {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	u := c.url(addr, path)
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.auth.Sign(req, bodyHash)
+	signSender(req, c.node, bodyHash)
+
+	var timer *time.Timer
+	if c.timeout > 0 {
+		timer = time.AfterFunc(c.timeout, func() { cancel(errRequestTimeout) })
+		defer timer.Stop()
+	}
+	if req.Body != nil {
+		req.Body = &progressBody{ReadCloser: req.Body, fn: func(n int) {
+			if timer != nil {
+				timer.Reset(c.timeout)
+			}
+			if c.progress != nil {
+				c.progress(int64(n))
+			}
+		}}
+		req.GetBody = nil
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if context.Cause(ctx) == errRequestTimeout {
+			return fmt.Errorf("%s %s: no progress for %s", method, u, c.timeout)
+		}
+		return fmt.Errorf("%s %s: %w", method, u, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{Code: resp.StatusCode, Body: respBody}
+	}
+
+	if err := json.Unmarshal(respBody, result); err != nil {
+		return fmt.Errorf("parse response: %w", err)
+	}
+	return nil
+}
+
+// progressBody calls fn with the size of every read from a request body.
+type progressBody struct {
+	io.ReadCloser
+	fn func(n int)
+}
+
+func (b *progressBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.fn(n)
+	}
+	return n, err
+}
+
+// statusError is returned for non-200 responses.
+type statusError struct {
+	Code int
+	Body []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.Code, bytes.TrimSpace(e.Body))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
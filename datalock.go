@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+const dataLockFile = "lock"
+
+var errDataDirLocked = errors.New("in use by another distrib process")
+
+// lockDataDir makes sure only one process works on a store at a time, so
+// that distrib gc can't remove what a running server is writing. The lock
+// is held until the process exits.
+func lockDataDir(dataDir string) error {
+	err := lockFile(filepath.Join(dataDir, dataLockFile))
+	if errors.Is(err, errDataDirLocked) {
+		return fmt.Errorf("data directory %s is %w (is distrib serve running?)", dataDir, err)
+	}
+	if err != nil {
+		return fmt.Errorf("lock data directory: %w", err)
+	}
+	return nil
+}
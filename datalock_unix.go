@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile creates path if needed and takes an exclusive lock on it without
+// waiting. The file is never closed, so the lock goes away when the process
+// exits.
+func lockFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+	}
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errDataDirLocked
+	}
+	return err
+}
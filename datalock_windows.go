@@ -0,0 +1,27 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION, which syscall doesn't
+// define.
+const errorSharingViolation syscall.Errno = 32
+
+// lockFile creates path if needed and opens it without sharing, which
+// locks out every other process. The handle is never closed, so the lock
+// goes away when the process exits.
+func lockFile(path string) error {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	_, err = syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if errors.Is(err, errorSharingViolation) {
+		return errDataDirLocked
+	}
+	return err
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,39 +23,391 @@ const (
 	discoveryResponse = "DISTRIB-HERE"
 )
 
+// discoveryVersion is the version of the announcement payload below.
+const discoveryVersion = 1
+
+// discoveryGroup6 is the IPv6 link-local multicast group for discovery
+// requests (ff02::114 is set aside for experiments).
+var discoveryGroup6 = net.ParseIP("ff02::114")
+
 type Peer struct {
-	Name string
-	Addr string // "ip:httpPort"
+	Name         string   `json:"name"`
+	Addr         string   `json:"addr"`                  // "ip:httpPort"
+	Fingerprint  string   `json:"fingerprint,omitempty"` // TLS certificate SHA256, if advertised
+	Version      string   `json:"version,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Key          string   `json:"key,omitempty"` // node public key (hex Ed25519)
+	Verified     bool     `json:"-"`             // the reply was signed by Key for our nonce; never cached
+}
+
+// describe formats a peer for listings: "name (addr) [tag, tag]".
+func (p Peer) describe() string {
+	s := fmt.Sprintf("%s (%s)", p.Name, p.Addr)
+	if len(p.Tags) > 0 {
+		s += " [" + strings.Join(p.Tags, ", ") + "]"
+	}
+	return s
+}
+
+func (p Peer) hasTag(tag string) bool {
+	for _, t := range p.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// announcement is what a receiver says about itself in reply to discovery.
+// Older clients only understand a reply that is exactly
+// "DISTRIB-HERE name port", so that is all a bare request gets. Requests
+// that carry a nonce come from newer clients, and their reply adds the
+// announcement as a JSON line after it.
+type announcement struct {
+	V            int      `json:"v"`
+	Name         string   `json:"name"`
+	Port         int      `json:"port"`
+	Fingerprint  string   `json:"fingerprint,omitempty"`
+	Version      string   `json:"version,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Key          string   `json:"key,omitempty"`
+	Sig          string   `json:"sig,omitempty"` // over signedBytes, when the request had a nonce
+}
+
+func (a announcement) reply() []byte {
+	payload, _ := json.Marshal(a)
+	return fmt.Appendf(a.legacyReply(), "%s\n", payload)
+}
+
+// legacyReply is the reply every version of the client understands.
+func (a announcement) legacyReply() []byte {
+	return fmt.Appendf(nil, "%s %s %d\n", discoveryResponse, a.Name, a.Port)
+}
+
+// discoveryRequests returns the requests a client sends: a bare one, which
+// receivers of every version answer with a name and port, and one carrying
+// nonce, which newer receivers answer with a signed announcement. Older
+// receivers ignore the second.
+func discoveryRequests(nonce string) [][]byte {
+	return [][]byte{
+		[]byte(discoveryMagic + "\n"),
+		[]byte(discoveryMagic + "\nnonce=" + nonce + "\n"),
+	}
+}
+
+// parseRequest returns whether data is a discovery request and the nonce it
+// carries, if any.
+func parseRequest(data []byte) (ok bool, nonce string) {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if strings.TrimSpace(lines[0]) != discoveryMagic {
+		return false, ""
+	}
+	for _, line := range lines[1:] {
+		if v, found := strings.CutPrefix(strings.TrimSpace(line), "nonce="); found && len(v) <= 64 {
+			nonce = v
+		}
+	}
+	return true, nonce
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseReply parses a discovery reply received from host, checking its
+// signature against the nonce the request carried.
+func parseReply(data []byte, host, nonce string) (Peer, bool) {
+	first, rest, _ := bytes.Cut(data, []byte("\n"))
+	line := strings.TrimSpace(string(first))
+	if !strings.HasPrefix(line, discoveryResponse) {
+		return Peer{}, false
+	}
+
+	// DISTRIB-HERE <name> <port>
+	parts := strings.Fields(line)
+	if len(parts) != 3 {
+		return Peer{}, false
+	}
+	peer := Peer{Name: parts[1], Addr: net.JoinHostPort(host, parts[2])}
+
+	var a announcement
+	rest = bytes.TrimSpace(rest)
+	if len(rest) == 0 || json.Unmarshal(rest, &a) != nil || a.V < 1 {
+		return peer, true
+	}
+	if a.Name != "" {
+		peer.Name = a.Name
+	}
+	if a.Port > 0 {
+		peer.Addr = net.JoinHostPort(host, strconv.Itoa(a.Port))
+	}
+	if a.Fingerprint != "" {
+		peer.Fingerprint = a.Fingerprint
+	}
+	peer.Version = a.Version
+	peer.Tags = a.Tags
+	peer.Capabilities = a.Capabilities
+	peer.Key = a.Key
+	peer.Verified = a.verify(nonce)
+	return peer, true
+}
+
+// parseTags splits a comma-separated tag list, lowercasing and dropping
+// duplicates.
+func parseTags(list string) []string {
+	var tags []string
+	for _, t := range strings.Split(list, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" && !slices.Contains(tags, t) {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// discoveryConfig selects how clients look for receivers.
+type discoveryConfig struct {
+	method   string // "broadcast", "mdns" or "both"
+	port     int    // UDP broadcast port
+	mdnsAddr string // multicast group for mDNS
+	timeout  time.Duration
+	scan     string // comma-separated CIDRs to sweep with unicast probes
+	scanPort int    // HTTP port probed during a sweep
+}
+
+// addDiscoveryFlags registers the discovery flags shared by the client
+// commands.
+func addDiscoveryFlags(fs *flag.FlagSet) *discoveryConfig {
+	d := &discoveryConfig{}
+	fs.StringVar(&d.method, "discovery", "both", "How to find receivers: broadcast, mdns or both")
+	fs.IntVar(&d.port, "discovery-port", defaultDiscoveryPort, "UDP discovery port")
+	fs.StringVar(&d.mdnsAddr, "mdns-addr", defaultMDNSAddr, "Multicast group and port for mDNS")
+	fs.DurationVar(&d.timeout, "timeout", 2*time.Second, "Discovery timeout")
+	fs.StringVar(&d.scan, "scan", "", "Also probe every address in these comma-separated CIDRs (e.g. 192.168.1.0/24)")
+	fs.IntVar(&d.scanPort, "scan-port", defaultHTTPPort, "HTTP port to probe with -scan")
+	return d
+}
+
+// validDiscoveryMethod reports whether method is one of the -discovery values.
+func validDiscoveryMethod(method string) bool {
+	return method == "broadcast" || method == "mdns" || method == "both"
+}
+
+type discoveryResult struct {
+	peers []Peer
+	err   error
+}
+
+// peerNames lists the names of peers, comma separated.
+func peerNames(peers []Peer) string {
+	names := make([]string, len(peers))
+	for i, p := range peers {
+		names[i] = p.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// containsPeer reports whether peers has p, by address or fingerprint.
+func containsPeer(peers []Peer, p Peer) bool {
+	for _, q := range peers {
+		if q.Addr == p.Addr || (p.Fingerprint != "" && q.Fingerprint == p.Fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the discovery flags, so mistakes are reported before
+// anything is sent.
+func (d *discoveryConfig) validate() error {
+	if !validDiscoveryMethod(d.method) {
+		return fmt.Errorf("unknown discovery method %q (want broadcast, mdns or both)", d.method)
+	}
+	_, err := parseScanPrefixes(d.scan)
+	return err
+}
+
+// discover finds receivers with broadcast and/or mDNS, plus a sweep of the
+// -scan ranges, all at the same time. A receiver found several ways is
+// listed once.
+func discover(d *discoveryConfig) ([]Peer, error) {
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+	prefixes, _ := parseScanPrefixes(d.scan)
+
+	nonce := newNonce()
+	var broadcast, mdns discoveryResult
+	var scanned []Peer
+	var wg sync.WaitGroup
+	if d.method != "mdns" {
+		wg.Go(func() { broadcast.peers, broadcast.err = discoverPeers(d.port, d.timeout, nonce) })
+	}
+	if d.method != "broadcast" {
+		wg.Go(func() { mdns.peers, mdns.err = browseMDNS(d.mdnsAddr, d.timeout) })
+	}
+	if len(prefixes) > 0 {
+		wg.Go(func() { scanned = scanSubnets(prefixes, d.port, d.scanPort, d.timeout, nonce) })
+	}
+	wg.Wait()
+
+	// A method failing (say, no multicast route) is fine as long as another
+	// one worked.
+	if len(prefixes) == 0 {
+		if broadcast.err != nil && (mdns.err != nil || d.method == "broadcast") {
+			return nil, broadcast.err
+		}
+		if mdns.err != nil && (broadcast.err != nil || d.method == "mdns") {
+			return nil, mdns.err
+		}
+	}
+	return mergePeers(broadcast.peers, mdns.peers, scanned), nil
+}
+
+// mergePeers joins peer lists, keeping the first entry for each receiver
+// and filling in what it lacks from later ones. Entries are the same
+// receiver when they share an address or a TLS fingerprint, so a machine
+// that answered over both IPv4 and IPv6 is only pushed to once.
+func mergePeers(lists ...[]Peer) []Peer {
+	var peers []Peer
+	byAddr := make(map[string]int)
+	byFingerprint := make(map[string]int)
+	for _, list := range lists {
+		for _, p := range list {
+			i, ok := byAddr[p.Addr]
+			if !ok && p.Fingerprint != "" {
+				i, ok = byFingerprint[p.Fingerprint]
+			}
+			if !ok {
+				i = len(peers)
+				peers = append(peers, p)
+			}
+			q := &peers[i]
+			if p.Verified && !q.Verified {
+				// A signed reply says who is at this address; an unsigned
+				// one for the same receiver may have been spoofed.
+				q.Name, q.Addr, q.Fingerprint, q.Key, q.Verified = p.Name, p.Addr, p.Fingerprint, p.Key, true
+			}
+			if q.Key == "" {
+				q.Key = p.Key
+			}
+			if q.Fingerprint == "" {
+				q.Fingerprint = p.Fingerprint
+			}
+			if q.Version == "" {
+				q.Version = p.Version
+			}
+			if q.Tags == nil {
+				q.Tags = p.Tags
+			}
+			if q.Capabilities == nil {
+				q.Capabilities = p.Capabilities
+			}
+			byAddr[p.Addr] = i
+			if q.Fingerprint != "" {
+				byFingerprint[q.Fingerprint] = i
+			}
+		}
+	}
+	return peers
 }
 
-func discoverPeers(discoveryPort int, timeout time.Duration) ([]Peer, error) {
-	conn, err := net.ListenPacket("udp4", ":0")
+// targetAddr turns a -target value into host:port, adding the default HTTP
+// port when there is none. IPv6 addresses need brackets to carry a port
+// ("[fe80::1%eth0]:9848"); without one they may be given bare.
+func targetAddr(target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
 	if err != nil {
-		return nil, fmt.Errorf("open UDP socket: %w", err)
+		host = strings.TrimSuffix(strings.TrimPrefix(target, "["), "]")
+		port = strconv.Itoa(defaultHTTPPort)
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid target %q: missing host", target)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid target %q: bad port %q", target, port)
+	}
+	if strings.Contains(host, ":") {
+		ip, _, _ := strings.Cut(host, "%")
+		if net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("invalid target %q: bad IPv6 address", target)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// discoverPeers broadcasts a discovery request over IPv4 and multicasts it
+// to discoveryGroup6 on every IPv6 interface, and collects the replies until
+// timeout.
+func discoverPeers(discoveryPort int, timeout time.Duration, nonce string) ([]Peer, error) {
+	conn4, err4 := net.ListenPacket("udp4", ":0")
+	conn6, err6 := net.ListenPacket("udp6", ":0")
+	if err4 != nil && err6 != nil {
+		return nil, fmt.Errorf("open UDP socket: %w", err4)
 	}
-	defer conn.Close()
 
-	msg := []byte(discoveryMagic + "\n")
+	msgs := discoveryRequests(nonce)
+	deadline := time.Now().Add(timeout)
+	var peers4, peers6 []Peer
+	var wg sync.WaitGroup
 
-	// Send to 255.255.255.255
-	broadcastAddr := &net.UDPAddr{IP: net.IPv4(255, 255, 255, 255), Port: discoveryPort}
-	if _, err := conn.WriteTo(msg, broadcastAddr); err != nil {
-		log.Printf("broadcast to 255.255.255.255: %v", err)
+	if conn4 != nil {
+		defer conn4.Close()
+
+		// Send to 255.255.255.255
+		broadcastAddr := &net.UDPAddr{IP: net.IPv4(255, 255, 255, 255), Port: discoveryPort}
+		if err := sendAll(conn4, msgs, broadcastAddr); err != nil {
+			log.Printf("broadcast to 255.255.255.255: %v", err)
+		}
+
+		// Also send to each interface's directed broadcast address
+		for _, ip := range interfaceBroadcastAddrs() {
+			addr := &net.UDPAddr{IP: ip, Port: discoveryPort}
+			if err := sendAll(conn4, msgs, addr); err != nil {
+				log.Printf("broadcast to %s: %v", ip, err)
+			}
+		}
+		wg.Go(func() { peers4 = readReplies(conn4, deadline, nonce) })
+	}
+
+	if conn6 != nil {
+		defer conn6.Close()
+
+		// Link-local multicast needs the interface as the address's zone.
+		for _, iface := range multicastInterfaces6() {
+			addr := &net.UDPAddr{IP: discoveryGroup6, Port: discoveryPort, Zone: iface.Name}
+			if err := sendAll(conn6, msgs, addr); err != nil {
+				log.Printf("multicast to %s: %v", addr, err)
+			}
+		}
+		wg.Go(func() { peers6 = readReplies(conn6, deadline, nonce) })
 	}
 
-	// Also send to each interface's directed broadcast address
-	for _, ip := range interfaceBroadcastAddrs() {
-		addr := &net.UDPAddr{IP: ip, Port: discoveryPort}
+	wg.Wait()
+	return mergePeers(peers4, peers6), nil
+}
+
+func sendAll(conn net.PacketConn, msgs [][]byte, addr net.Addr) error {
+	for _, msg := range msgs {
 		if _, err := conn.WriteTo(msg, addr); err != nil {
-			log.Printf("broadcast to %s: %v", ip, err)
+			return err
 		}
 	}
+	return nil
+}
 
-	conn.SetReadDeadline(time.Now().Add(timeout))
+// readReplies collects discovery replies on conn until deadline. A peer's
+// address keeps the zone of link-local replies, e.g. "[fe80::1%eth0]:9848".
+// Newer receivers answer twice, once signed; the signed reply wins.
+func readReplies(conn net.PacketConn, deadline time.Time, nonce string) []Peer {
+	conn.SetReadDeadline(deadline)
 
-	seen := make(map[string]bool)
 	var peers []Peer
-	buf := make([]byte, 1024)
+	buf := make([]byte, 8192)
 
 	for {
 		n, addr, err := conn.ReadFrom(buf)
@@ -54,69 +415,113 @@ func discoverPeers(discoveryPort int, timeout time.Duration) ([]Peer, error) {
 			break // timeout or error
 		}
 
-		line := strings.TrimSpace(string(buf[:n]))
-		if !strings.HasPrefix(line, discoveryResponse) {
-			continue
-		}
-
-		parts := strings.Fields(line)
-		if len(parts) != 3 {
-			continue
-		}
-
-		name := parts[1]
-		httpPort := parts[2]
-
 		host, _, _ := net.SplitHostPort(addr.String())
-		peerAddr := net.JoinHostPort(host, httpPort)
-
-		if seen[peerAddr] {
+		peer, ok := parseReply(buf[:n], host, nonce)
+		if !ok {
 			continue
 		}
-		seen[peerAddr] = true
-
-		peers = append(peers, Peer{Name: name, Addr: peerAddr})
+		peers = mergePeers(peers, []Peer{peer})
 	}
 
-	return peers, nil
+	return peers
 }
 
-func listenForDiscovery(ctx context.Context, discoveryPort int, name string, httpPort int) error {
+// listenForDiscovery answers discovery requests on the IPv4 port and on
+// discoveryGroup6 on every IPv6 interface until ctx is done.
+func listenForDiscovery(ctx context.Context, discoveryPort int, a announcement, key ed25519.PrivateKey) error {
 	addr := &net.UDPAddr{Port: discoveryPort}
 	conn, err := net.ListenUDP("udp4", addr)
 	if err != nil {
 		return fmt.Errorf("listen UDP :%d: %w", discoveryPort, err)
 	}
-	defer conn.Close()
+	conns := []*net.UDPConn{conn}
+
+	// Joining a group is per interface, so each gets its own socket. A
+	// request may then be answered more than once; clients drop repeats.
+	for _, iface := range multicastInterfaces6() {
+		group := &net.UDPAddr{IP: discoveryGroup6, Port: discoveryPort}
+		conn6, err := net.ListenMulticastUDP("udp6", &iface, group)
+		if err != nil {
+			log.Printf("Discovery on %s: %v", iface.Name, err)
+			continue
+		}
+		conns = append(conns, conn6)
+	}
 
-	log.Printf("Discovery listener on :%d", discoveryPort)
+	log.Printf("Discovery listener on :%d and [%s]:%d", discoveryPort, discoveryGroup6, discoveryPort)
 
-	response := []byte(fmt.Sprintf("%s %s %d\n", discoveryResponse, name, httpPort))
-	buf := make([]byte, 1024)
+	a.V = discoveryVersion
 
-	go func() {
-		<-ctx.Done()
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Go(func() { answerDiscovery(ctx, conn, a, key) })
+	}
+	<-ctx.Done()
+	for _, conn := range conns {
 		conn.Close()
-	}()
+	}
+	wg.Wait()
+	return nil
+}
 
+func answerDiscovery(ctx context.Context, conn *net.UDPConn, a announcement, key ed25519.PrivateKey) {
+	buf := make([]byte, 1024)
 	for {
 		n, remoteAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
 			if ctx.Err() != nil {
-				return nil
+				return
 			}
 			log.Printf("UDP read error: %v", err)
 			continue
 		}
 
-		line := strings.TrimSpace(string(buf[:n]))
-		if line == discoveryMagic {
+		ok, nonce := parseRequest(buf[:n])
+		if !ok {
+			continue
+		}
+		var msg []byte
+		if nonce != "" {
+			reply := a
+			reply.sign(key, nonce)
+			msg = reply.reply()
+		} else {
 			log.Printf("Discovery request from %s", remoteAddr)
-			if _, err := conn.WriteToUDP(response, remoteAddr); err != nil {
-				log.Printf("UDP reply error: %v", err)
+			msg = a.legacyReply()
+		}
+		if _, err := conn.WriteToUDP(msg, remoteAddr); err != nil {
+			log.Printf("UDP reply error: %v", err)
+		}
+	}
+}
+
+// multicastInterfaces6 returns the interfaces that are up, support
+// multicast and have an IPv6 address.
+func multicastInterfaces6() []net.Interface {
+	var out []net.Interface
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() == nil {
+				out = append(out, iface)
+				break
 			}
 		}
 	}
+
+	return out
 }
 
 func interfaceBroadcastAddrs() []net.IP {
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func cmdGC(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dataDir := fs.String("data", "", "Data directory (default: ~/.distrib)")
+	grace := fs.Duration("grace", time.Hour, "Keep contents written more recently than this")
+	dryRun := fs.Bool("dry-run", false, "Only report what would be removed")
+	fs.Parse(args)
+
+	store, err := NewStore(resolveDataDir(*dataDir), 0, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	removed, freed, err := store.GC(*grace, *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d unreferenced object(s), %.1f MB\n", verb, removed, float64(freed)/(1<<20))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ListOptions controls the order and window of Store.List.
+type ListOptions struct {
+	Sort   string // "received_at" (default), "filename", "sender" or "size"
+	Desc   bool
+	Offset int
+	Limit  int // 0 means no limit
+}
+
+var listSorts = map[string]func(a, b *FileEntry) int{
+	"received_at": func(a, b *FileEntry) int { return a.ReceivedAt.Compare(b.ReceivedAt) },
+	"filename":    func(a, b *FileEntry) int { return strings.Compare(a.Filename, b.Filename) },
+	"sender":      func(a, b *FileEntry) int { return strings.Compare(a.Sender, b.Sender) },
+	"size":        func(a, b *FileEntry) int { return cmp.Compare(a.Size, b.Size) },
+}
+
+// storeIndex keeps every entry's metadata in memory, so lookups don't have
+// to read each meta.json on disk.
+type storeIndex struct {
+	mu       sync.RWMutex
+	byID     map[string]*FileEntry
+	byName   map[string]string              // filename + "\x00" + owner -> ID
+	bySHA256 map[string]map[string]struct{} // SHA256 -> IDs
+}
+
+func newStoreIndex() *storeIndex {
+	return &storeIndex{
+		byID:     make(map[string]*FileEntry),
+		byName:   make(map[string]string),
+		bySHA256: make(map[string]map[string]struct{}),
+	}
+}
+
+func nameKey(filename, owner string) string {
+	return filename + "\x00" + owner
+}
+
+// owner is who may update an entry: the sender's node key if its pushes
+// are signed, so that no one else can replace its files by claiming its
+// name. Entries from older, unsigned clients only have the name.
+func owner(sender, senderKey string) string {
+	if senderKey != "" {
+		return "key:" + senderKey
+	}
+	return "name:" + sender
+}
+
+func (x *storeIndex) put(entry *FileEntry) {
+	e := *entry
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(e.ID)
+	x.byID[e.ID] = &e
+	x.byName[nameKey(e.Filename, owner(e.Sender, e.SenderKey))] = e.ID
+	ids := x.bySHA256[e.SHA256]
+	if ids == nil {
+		ids = make(map[string]struct{})
+		x.bySHA256[e.SHA256] = ids
+	}
+	ids[e.ID] = struct{}{}
+}
+
+func (x *storeIndex) remove(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(id)
+}
+
+func (x *storeIndex) removeLocked(id string) {
+	e, ok := x.byID[id]
+	if !ok {
+		return
+	}
+	delete(x.byID, id)
+	if key := nameKey(e.Filename, owner(e.Sender, e.SenderKey)); x.byName[key] == id {
+		delete(x.byName, key)
+	}
+	if ids := x.bySHA256[e.SHA256]; ids != nil {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(x.bySHA256, e.SHA256)
+		}
+	}
+}
+
+func (x *storeIndex) get(id string) (FileEntry, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	e, ok := x.byID[id]
+	if !ok {
+		return FileEntry{}, false
+	}
+	return *e, true
+}
+
+func (x *storeIndex) count() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.byID)
+}
+
+func (x *storeIndex) findByName(filename, owner string) (FileEntry, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	id, ok := x.byName[nameKey(filename, owner)]
+	if !ok {
+		return FileEntry{}, false
+	}
+	return *x.byID[id], true
+}
+
+func (x *storeIndex) findBySHA256(sha string) []FileEntry {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var files []FileEntry
+	for id := range x.bySHA256[sha] {
+		files = append(files, *x.byID[id])
+	}
+	slices.SortFunc(files, func(a, b FileEntry) int { return strings.Compare(a.ID, b.ID) })
+	return files
+}
+
+// list returns the window of entries selected by opts and the total number
+// of entries.
+func (x *storeIndex) list(opts ListOptions) ([]FileEntry, int) {
+	x.mu.RLock()
+	entries := make([]*FileEntry, 0, len(x.byID))
+	for _, e := range x.byID {
+		entries = append(entries, e)
+	}
+	x.mu.RUnlock()
+
+	less, ok := listSorts[opts.Sort]
+	if !ok {
+		less = listSorts["received_at"]
+	}
+	slices.SortFunc(entries, func(a, b *FileEntry) int {
+		c := less(a, b)
+		if c == 0 {
+			c = strings.Compare(a.ID, b.ID)
+		}
+		if opts.Desc {
+			return -c
+		}
+		return c
+	})
+
+	total := len(entries)
+	start := min(max(opts.Offset, 0), total)
+	end := total
+	if opts.Limit > 0 {
+		end = min(start+opts.Limit, total)
+	}
+
+	files := make([]FileEntry, 0, end-start)
+	for _, e := range entries[start:end] {
+		files = append(files, *e)
+	}
+	return files, total
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const knownPeersFile = "known_peers"
+
+// KnownPeers pins receiver certificate fingerprints by address, like SSH's
+// known_hosts. The first certificate seen for an address is trusted and
+// recorded; any later change is refused.
+type KnownPeers struct {
+	path string
+
+	mu      sync.Mutex
+	pins    map[string]string // addr -> fingerprint
+	adverts map[string]string // addr -> fingerprint announced via discovery
+}
+
+func LoadKnownPeers(dataDir string) (*KnownPeers, error) {
+	k := &KnownPeers{
+		path:    filepath.Join(dataDir, knownPeersFile),
+		pins:    make(map[string]string),
+		adverts: make(map[string]string),
+	}
+
+	f, err := os.Open(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open known peers: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		k.pins[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read known peers: %w", err)
+	}
+
+	return k, nil
+}
+
+// Advertise records the fingerprint a peer announced during discovery. A
+// first connection to that address must present the same certificate.
+func (k *KnownPeers) Advertise(addr, fingerprint string) {
+	if fingerprint == "" {
+		return
+	}
+	k.mu.Lock()
+	k.adverts[addr] = fingerprint
+	k.mu.Unlock()
+}
+
+// Check verifies the certificate presented by addr, pinning it on first use.
+func (k *KnownPeers) Check(addr string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+	fp := certFingerprint(cs.PeerCertificates[0].Raw)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// The announcement is checked even for pinned addresses, so a peer whose
+	// discovery reply doesn't match what it presents is never trusted.
+	if advertised, ok := k.adverts[addr]; ok && advertised != fp {
+		return fmt.Errorf("certificate fingerprint %s does not match the one announced during discovery (%s)", fp, advertised)
+	}
+
+	if pinned, ok := k.pins[addr]; ok {
+		if pinned != fp {
+			return &FingerprintMismatchError{Addr: addr, Want: pinned, Got: fp, Path: k.path}
+		}
+		return nil
+	}
+
+	k.pins[addr] = fp
+	if err := k.save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Trusting new peer %s (fingerprint %s)\n", addr, fp)
+	return nil
+}
+
+func (k *KnownPeers) save() error {
+	if err := os.MkdirAll(filepath.Dir(k.path), 0755); err != nil {
+		return fmt.Errorf("create data dir: %w", err)
+	}
+
+	addrs := make([]string, 0, len(k.pins))
+	for addr := range k.pins {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var b strings.Builder
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, "%s %s\n", addr, k.pins[addr])
+	}
+	if err := writeFileAtomic(k.path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("write known peers: %w", err)
+	}
+	return nil
+}
+
+// FingerprintMismatchError is returned when a pinned peer presents a
+// different certificate than the one recorded on first contact.
+type FingerprintMismatchError struct {
+	Addr, Want, Got, Path string
+}
+
+func (e *FingerprintMismatchError) Error() string {
+	return fmt.Sprintf(`
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+@    WARNING: PEER CERTIFICATE FINGERPRINT HAS CHANGED!    @
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+Someone could be impersonating %s, or the receiver's
+data directory was reset.
+  expected: %s
+  got:      %s
+If the change is expected, remove the line for %s from
+%s and push again.`, e.Addr, e.Want, e.Got, e.Addr, e.Path)
+}
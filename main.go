@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
 )
 
 const (
@@ -25,6 +27,12 @@ func main() {
 		cmdPush(os.Args[2:])
 	case "push-assets":
 		cmdPushAssets(os.Args[2:])
+	case "peers":
+		cmdPeers(os.Args[2:])
+	case "pair":
+		cmdPair(os.Args[2:])
+	case "gc":
+		cmdGC(os.Args[2:])
 	case "version":
 		fmt.Println("distrib", version)
 	default:
@@ -40,8 +48,23 @@ Usage:
   distrib serve [flags]                                      Start the receiver daemon
   distrib push <file> [flags]                                Push an HTML file to peers
   distrib push-assets --for <file.html> <asset>... [flags]   Push asset files for an HTML file
+  distrib peers [flags]                                      List receivers on the network
+  distrib pair <receiver> [flags]                            Pair with a receiver using the code it shows
+  distrib gc [flags]                                         Remove stored contents no file uses
   distrib version                                            Print version
 
 Run 'distrib <command> -help' for details.
 `)
 }
+
+// resolveDataDir returns dir, or ~/.distrib when dir is empty.
+func resolveDataDir(dir string) string {
+	if dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatalf("Cannot determine home directory: %v", err)
+	}
+	return filepath.Join(home, ".distrib")
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Multicast DNS (RFC 6762) with DNS-SD (RFC 6763): receivers advertise a
+// _distrib._tcp service and answer queries for it, and clients browse for
+// it. Only the few record types distrib needs are encoded and parsed.
+
+const (
+	defaultMDNSAddr  = "224.0.0.251:5353"
+	mdnsService      = "_distrib._tcp.local."
+	mdnsServicesEnum = "_services._dns-sd._udp.local."
+	mdnsTTL          = 120
+	mdnsLegacyTTL    = 10 // for replies to one-shot queries (RFC 6762 §6.7)
+)
+
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN    = 1
+	dnsCacheFlush = 0x8000 // top bit of the class in mDNS answers
+	dnsFlagQR     = 0x8000
+	dnsFlagAA     = 0x0400
+)
+
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type dnsRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+
+	Target string   // PTR, SRV
+	Port   uint16   // SRV
+	Text   []string // TXT
+	IP     net.IP   // A
+}
+
+type dnsMessage struct {
+	ID         uint16
+	Flags      uint16
+	Questions  []dnsQuestion
+	Answers    []dnsRecord
+	Additional []dnsRecord
+}
+
+func (m *dnsMessage) pack() []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	binary.BigEndian.PutUint16(b[2:], m.Flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.Additional)))
+
+	for _, q := range m.Questions {
+		b = appendDNSName(b, q.Name)
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+	for _, r := range m.Answers {
+		b = r.append(b)
+	}
+	for _, r := range m.Additional {
+		b = r.append(b)
+	}
+	return b
+}
+
+func (r dnsRecord) append(b []byte) []byte {
+	b = appendDNSName(b, r.Name)
+	b = binary.BigEndian.AppendUint16(b, r.Type)
+	b = binary.BigEndian.AppendUint16(b, r.Class)
+	b = binary.BigEndian.AppendUint32(b, r.TTL)
+
+	lenAt := len(b)
+	b = append(b, 0, 0)
+	switch r.Type {
+	case dnsTypePTR:
+		b = appendDNSName(b, r.Target)
+	case dnsTypeSRV:
+		b = append(b, 0, 0, 0, 0) // priority, weight
+		b = binary.BigEndian.AppendUint16(b, r.Port)
+		b = appendDNSName(b, r.Target)
+	case dnsTypeTXT:
+		for _, s := range r.Text {
+			s = s[:min(len(s), 255)]
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+	case dnsTypeA:
+		b = append(b, r.IP.To4()...)
+	}
+	binary.BigEndian.PutUint16(b[lenAt:], uint16(len(b)-lenAt-2))
+	return b
+}
+
+// appendDNSName encodes a dotted name without compression.
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+var errDNSShort = errors.New("dns message too short")
+
+func parseDNSMessage(msg []byte) (*dnsMessage, error) {
+	if len(msg) < 12 {
+		return nil, errDNSShort
+	}
+	m := &dnsMessage{
+		ID:    binary.BigEndian.Uint16(msg[0:]),
+		Flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+	ns := int(binary.BigEndian.Uint16(msg[8:]))
+	ar := int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for range qd {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(msg) {
+			return nil, errDNSShort
+		}
+		m.Questions = append(m.Questions, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[next:]),
+			Class: binary.BigEndian.Uint16(msg[next+2:]),
+		})
+		off = next + 4
+	}
+
+	for i := range an + ns + ar {
+		r, next, err := readDNSRecord(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		switch {
+		case i < an:
+			m.Answers = append(m.Answers, r)
+		case i >= an+ns:
+			m.Additional = append(m.Additional, r)
+		}
+	}
+	return m, nil
+}
+
+func readDNSRecord(msg []byte, off int) (dnsRecord, int, error) {
+	var r dnsRecord
+	name, off, err := readDNSName(msg, off)
+	if err != nil {
+		return r, 0, err
+	}
+	if off+10 > len(msg) {
+		return r, 0, errDNSShort
+	}
+	r.Name = name
+	r.Type = binary.BigEndian.Uint16(msg[off:])
+	r.Class = binary.BigEndian.Uint16(msg[off+2:])
+	r.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	start, end := off+10, off+10+rdlen
+	if end > len(msg) {
+		return r, 0, errDNSShort
+	}
+	rdata := msg[start:end]
+
+	switch r.Type {
+	case dnsTypePTR:
+		r.Target, _, err = readDNSName(msg, start)
+	case dnsTypeSRV:
+		if rdlen < 7 {
+			return r, 0, errDNSShort
+		}
+		r.Port = binary.BigEndian.Uint16(rdata[4:])
+		r.Target, _, err = readDNSName(msg, start+6)
+	case dnsTypeTXT:
+		for len(rdata) > 0 {
+			n := int(rdata[0])
+			if 1+n > len(rdata) {
+				return r, 0, errDNSShort
+			}
+			r.Text = append(r.Text, string(rdata[1:1+n]))
+			rdata = rdata[1+n:]
+		}
+	case dnsTypeA:
+		if rdlen == 4 {
+			r.IP = net.IP(append([]byte(nil), rdata...))
+		}
+	}
+	return r, end, err
+}
+
+// readDNSName decodes a possibly compressed name at off and returns it with
+// a trailing dot, along with the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSShort
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSShort
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errors.New("dns name has too many pointers")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSShort
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// mdnsLabel turns a receiver name into a single DNS label. Dots would split
+// it, so they are replaced.
+func mdnsLabel(name string) string {
+	label := strings.ReplaceAll(name, ".", "-")
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return label
+}
+
+func mdnsInstance(name string) string {
+	return mdnsLabel(name) + "." + mdnsService
+}
+
+// mdnsResponse builds the records describing a receiver: a PTR answer for
+// the service, plus SRV, TXT and A records for the instance.
+func mdnsResponse(a announcement, ttl uint32) *dnsMessage {
+	instance := mdnsInstance(a.Name)
+	host := mdnsLabel(a.Name) + ".local."
+
+	txt := []string{
+		"txtvers=" + strconv.Itoa(discoveryVersion),
+		"name=" + a.Name,
+		"version=" + a.Version,
+		"fp=" + a.Fingerprint,
+	}
+	if len(a.Tags) > 0 {
+		txt = append(txt, "tags="+strings.Join(a.Tags, ","))
+	}
+	if len(a.Capabilities) > 0 {
+		txt = append(txt, "caps="+strings.Join(a.Capabilities, ","))
+	}
+	if a.Key != "" {
+		// mDNS has no nonce to sign, so the key is only a hint; a peer
+		// found this way is unverified until a signed reply confirms it.
+		txt = append(txt, "key="+a.Key)
+	}
+
+	m := &dnsMessage{
+		Flags:   dnsFlagQR | dnsFlagAA,
+		Answers: []dnsRecord{{Name: mdnsService, Type: dnsTypePTR, Class: dnsClassIN, TTL: ttl, Target: instance}},
+		Additional: []dnsRecord{
+			{Name: instance, Type: dnsTypeSRV, Class: dnsClassIN | dnsCacheFlush, TTL: ttl, Port: uint16(a.Port), Target: host},
+			{Name: instance, Type: dnsTypeTXT, Class: dnsClassIN | dnsCacheFlush, TTL: ttl, Text: txt},
+		},
+	}
+	for _, ip := range localIPv4Addrs() {
+		m.Additional = append(m.Additional, dnsRecord{Name: host, Type: dnsTypeA, Class: dnsClassIN | dnsCacheFlush, TTL: ttl, IP: ip})
+	}
+	return m
+}
+
+// asksForService reports whether a query is about distrib receivers, either
+// directly or through DNS-SD service type enumeration.
+func asksForService(questions []dnsQuestion, instance string) (service, enum bool) {
+	for _, q := range questions {
+		if q.Type != dnsTypePTR && q.Type != dnsTypeSRV && q.Type != dnsTypeTXT && q.Type != dnsTypeANY {
+			continue
+		}
+		switch {
+		case strings.EqualFold(q.Name, mdnsService), strings.EqualFold(q.Name, instance):
+			service = true
+		case strings.EqualFold(q.Name, mdnsServicesEnum):
+			enum = true
+		}
+	}
+	return service, enum
+}
+
+// advertiseMDNS announces the receiver on the multicast group at groupAddr
+// and answers queries for it until ctx is done.
+func advertiseMDNS(ctx context.Context, groupAddr string, a announcement) error {
+	gaddr, err := net.ResolveUDPAddr("udp4", groupAddr)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", groupAddr, err)
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, gaddr)
+	if err != nil {
+		return fmt.Errorf("join %s: %w", groupAddr, err)
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	instance := mdnsInstance(a.Name)
+	log.Printf("mDNS advertising %s on %s", instance, groupAddr)
+	if _, err := conn.WriteToUDP(mdnsResponse(a, mdnsTTL).pack(), gaddr); err != nil {
+		log.Printf("mDNS announce: %v", err)
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("mDNS read error: %v", err)
+			continue
+		}
+
+		query, err := parseDNSMessage(buf[:n])
+		if err != nil || query.Flags&dnsFlagQR != 0 {
+			continue
+		}
+		service, enum := asksForService(query.Questions, instance)
+		if !service && !enum {
+			continue
+		}
+
+		// Queries from a port other than the mDNS port come from simple
+		// one-shot resolvers (like distrib push), which expect a unicast
+		// reply echoing the query (RFC 6762 §6.7).
+		legacy := remote.Port != gaddr.Port
+		ttl := uint32(mdnsTTL)
+		if legacy {
+			ttl = mdnsLegacyTTL
+		}
+
+		resp := mdnsResponse(a, ttl)
+		if !service {
+			resp = &dnsMessage{Flags: dnsFlagQR | dnsFlagAA}
+		}
+		if enum {
+			resp.Answers = append(resp.Answers, dnsRecord{Name: mdnsServicesEnum, Type: dnsTypePTR, Class: dnsClassIN, TTL: ttl, Target: mdnsService})
+		}
+
+		dst := gaddr
+		if legacy {
+			resp.ID = query.ID
+			resp.Questions = query.Questions
+			for i := range resp.Additional {
+				resp.Additional[i].Class &^= dnsCacheFlush // not for plain DNS caches
+			}
+			dst = remote
+		}
+		if _, err := conn.WriteToUDP(resp.pack(), dst); err != nil {
+			log.Printf("mDNS reply error: %v", err)
+		}
+	}
+}
+
+// browseMDNS queries the multicast group at groupAddr for distrib receivers
+// and collects the replies until timeout.
+func browseMDNS(groupAddr string, timeout time.Duration) ([]Peer, error) {
+	gaddr, err := net.ResolveUDPAddr("udp4", groupAddr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", groupAddr, err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("open UDP socket: %w", err)
+	}
+	defer conn.Close()
+
+	query := &dnsMessage{
+		ID:        uint16(time.Now().UnixNano()),
+		Questions: []dnsQuestion{{Name: mdnsService, Type: dnsTypePTR, Class: dnsClassIN}},
+	}
+	if _, err := conn.WriteToUDP(query.pack(), gaddr); err != nil {
+		return nil, fmt.Errorf("send mDNS query: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	seen := make(map[string]bool)
+	var peers []Peer
+	buf := make([]byte, 9000)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // timeout or error
+		}
+		resp, err := parseDNSMessage(buf[:n])
+		if err != nil || resp.Flags&dnsFlagQR == 0 {
+			continue
+		}
+		for _, p := range peersFromMDNS(resp, remote.IP) {
+			if !seen[p.Addr] {
+				seen[p.Addr] = true
+				peers = append(peers, p)
+			}
+		}
+	}
+	return peers, nil
+}
+
+// peersFromMDNS reads the receivers described in an mDNS response. Like
+// broadcast discovery, the address is taken from where the reply came from,
+// which is the one this machine can reach.
+func peersFromMDNS(m *dnsMessage, from net.IP) []Peer {
+	records := append(m.Answers[:len(m.Answers):len(m.Answers)], m.Additional...)
+
+	var peers []Peer
+	for _, ptr := range records {
+		if ptr.Type != dnsTypePTR || !strings.EqualFold(ptr.Name, mdnsService) {
+			continue
+		}
+		peer := Peer{Name: strings.TrimSuffix(ptr.Target, "."+mdnsService)}
+		port := 0
+		for _, r := range records {
+			if !strings.EqualFold(r.Name, ptr.Target) {
+				continue
+			}
+			switch r.Type {
+			case dnsTypeSRV:
+				port = int(r.Port)
+			case dnsTypeTXT:
+				applyTXT(&peer, r.Text)
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		peer.Addr = net.JoinHostPort(from.String(), strconv.Itoa(port))
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func applyTXT(p *Peer, txt []string) {
+	for _, kv := range txt {
+		key, value, _ := strings.Cut(kv, "=")
+		switch strings.ToLower(key) {
+		case "name":
+			if value != "" {
+				p.Name = value
+			}
+		case "version":
+			p.Version = value
+		case "fp":
+			p.Fingerprint = value
+		case "tags":
+			p.Tags = parseTags(value)
+		case "caps":
+			p.Capabilities = strings.Split(value, ",")
+		case "key":
+			p.Key = value
+		}
+	}
+}
+
+// localIPv4Addrs returns the IPv4 addresses of the interfaces that are up,
+// for A records.
+func localIPv4Addrs() []net.IP {
+	var ips []net.IP
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.IP.To4())
+			}
+		}
+	}
+	return ips
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMDNSAdvertiseAndBrowse(t *testing.T) {
+	// A group and port of its own, so the test neither needs nor disturbs
+	// a real mDNS responder on 224.0.0.251:5353.
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	group := fmt.Sprintf("239.255.77.1:%d", port)
+
+	a := announcement{
+		V:            discoveryVersion,
+		Name:         "test.receiver",
+		Port:         19848,
+		Fingerprint:  "ab12",
+		Version:      "test",
+		Tags:         []string{"lab", "office"},
+		Capabilities: []string{"tls", "pair"},
+		Key:          "cd34",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- advertiseMDNS(ctx, group, a) }()
+
+	var peers []Peer
+	for range 10 {
+		select {
+		case err := <-done:
+			t.Skipf("multicast is not available here: %v", err)
+		default:
+		}
+		if peers, err = browseMDNS(group, 200*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if len(peers) > 0 {
+			break
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("advertiseMDNS: %v", err)
+	}
+
+	if len(peers) != 1 {
+		t.Fatalf("found %d peers, want 1: %+v", len(peers), peers)
+	}
+	p := peers[0]
+	if _, port, _ := net.SplitHostPort(p.Addr); port != strconv.Itoa(a.Port) {
+		t.Errorf("addr = %s, want port %d", p.Addr, a.Port)
+	}
+	if p.Name != a.Name {
+		t.Errorf("name = %q, want %q", p.Name, a.Name)
+	}
+	if p.Fingerprint != a.Fingerprint || p.Version != a.Version || p.Key != a.Key {
+		t.Errorf("got fingerprint %q, version %q, key %q; want %q, %q, %q",
+			p.Fingerprint, p.Version, p.Key, a.Fingerprint, a.Version, a.Key)
+	}
+	if !slices.Equal(p.Tags, a.Tags) || !slices.Equal(p.Capabilities, a.Capabilities) {
+		t.Errorf("got tags %v, capabilities %v; want %v, %v", p.Tags, p.Capabilities, a.Tags, a.Capabilities)
+	}
+	if p.Verified {
+		t.Error("a peer found through mDNS must not be verified")
+	}
+}
+
+func TestReadDNSName(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		off     int
+		want    string
+		next    int
+		wantErr bool
+	}{
+		{name: "plain", msg: []byte("\x03foo\x05local\x00"), want: "foo.local.", next: 11},
+		{name: "root", msg: []byte{0}, want: ".", next: 1},
+		{name: "compressed", msg: []byte("\x05local\x00\x03foo\xc0\x00"), off: 7, want: "foo.local.", next: 13},
+		{name: "pointer to pointer", msg: []byte("\x05local\x00\xc0\x00\x03foo\xc0\x07"), off: 9, want: "foo.local.", next: 15},
+		{name: "empty", msg: nil, wantErr: true},
+		{name: "offset past end", msg: []byte{0}, off: 1, wantErr: true},
+		{name: "truncated label", msg: []byte("\x05lo"), wantErr: true},
+		{name: "missing terminator", msg: []byte("\x03foo"), wantErr: true},
+		{name: "truncated pointer", msg: []byte("\x03foo\xc0"), wantErr: true},
+		{name: "pointer past end", msg: []byte("\x03foo\xc0\x40"), wantErr: true},
+		{name: "pointer to itself", msg: []byte("\xc0\x00"), wantErr: true},
+		{name: "pointer loop", msg: []byte("\xc0\x02\xc0\x00"), wantErr: true},
+		{name: "loop through labels", msg: []byte("\x01a\xc0\x00"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, next, err := readDNSName(tt.msg, tt.off)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readDNSName = %q, %d; want an error", got, next)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || next != tt.next {
+				t.Errorf("readDNSName = %q, %d; want %q, %d", got, next, tt.want, tt.next)
+			}
+		})
+	}
+}
+
+func TestReadDNSRecord(t *testing.T) {
+	// name "a.", type, class IN, TTL 120, then rdlength and rdata.
+	record := func(typ uint16, rdata string) []byte {
+		b := []byte{1, 'a', 0, byte(typ >> 8), byte(typ), 0, 1, 0, 0, 0, 120, byte(len(rdata) >> 8), byte(len(rdata))}
+		return append(b, rdata...)
+	}
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		check   func(t *testing.T, r dnsRecord)
+		wantErr bool
+	}{
+		{
+			name: "PTR",
+			msg:  record(dnsTypePTR, "\x01b\xc0\x00"),
+			check: func(t *testing.T, r dnsRecord) {
+				if r.Target != "b.a." {
+					t.Errorf("target = %q, want b.a.", r.Target)
+				}
+			},
+		},
+		{
+			name: "SRV",
+			msg:  record(dnsTypeSRV, "\x00\x00\x00\x00\x4d\x18\x01h\x00"),
+			check: func(t *testing.T, r dnsRecord) {
+				if r.Port != 19736 || r.Target != "h." {
+					t.Errorf("got port %d, target %q", r.Port, r.Target)
+				}
+			},
+		},
+		{
+			name: "TXT",
+			msg:  record(dnsTypeTXT, "\x03k=v\x00"),
+			check: func(t *testing.T, r dnsRecord) {
+				if !slices.Equal(r.Text, []string{"k=v", ""}) {
+					t.Errorf("text = %q", r.Text)
+				}
+			},
+		},
+		{name: "truncated header", msg: record(dnsTypeA, "\x7f\x00\x00\x01")[:8], wantErr: true},
+		{name: "rdata past end", msg: record(dnsTypeA, "\x7f\x00\x00\x01")[:15], wantErr: true},
+		{name: "short SRV", msg: record(dnsTypeSRV, "\x00\x00\x00\x00\x4d\x18"), wantErr: true},
+		{name: "TXT string past rdata", msg: record(dnsTypeTXT, "\x05k=v"), wantErr: true},
+		{name: "PTR target loops", msg: record(dnsTypePTR, "\x01b\xc0\x0d"), wantErr: true},
+		{name: "PTR target truncated", msg: record(dnsTypePTR, "\x05b"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, next, err := readDNSRecord(tt.msg, 0)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readDNSRecord = %+v; want an error", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next != len(tt.msg) {
+				t.Errorf("next = %d, want %d", next, len(tt.msg))
+			}
+			tt.check(t, r)
+		})
+	}
+}
+
+func TestParseDNSMessage(t *testing.T) {
+	a := announcement{Name: "living-room", Port: 9848, Fingerprint: "ab12", Version: "test"}
+	resp := mdnsResponse(a, mdnsTTL)
+	packed := resp.pack()
+	records := uint16(len(resp.Answers) + len(resp.Additional))
+
+	m, err := parseDNSMessage(packed)
+	if err != nil {
+		t.Fatalf("parse packed response: %v", err)
+	}
+	peers := peersFromMDNS(m, net.IPv4(192, 0, 2, 1))
+	if len(peers) != 1 || peers[0].Name != a.Name || peers[0].Addr != "192.0.2.1:9848" || peers[0].Fingerprint != a.Fingerprint {
+		t.Errorf("peers = %+v", peers)
+	}
+
+	header := func(qd, an uint16) []byte {
+		return []byte{0, 0, 0x84, 0, byte(qd >> 8), byte(qd), byte(an >> 8), byte(an), 0, 0, 0, 0}
+	}
+	bad := []struct {
+		name string
+		msg  []byte
+	}{
+		{"short header", header(0, 0)[:11]},
+		{"missing question", header(1, 0)},
+		{"question without type", append(header(1, 0), 0, 0, 12)},
+		{"question name loops", append(header(1, 0), 0xc0, 12, 0, 12, 0, 1)},
+		{"missing answer", header(0, 1)},
+		{"answer count too high", append(header(0, records+1), packed[12:]...)},
+		{"last record truncated", packed[:len(packed)-1]},
+	}
+	for _, tt := range bad {
+		t.Run(tt.name, func(t *testing.T) {
+			if m, err := parseDNSMessage(tt.msg); err == nil {
+				t.Errorf("parseDNSMessage = %+v; want an error", m)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// migrate moves an entry stored before the object store into it. Older
+// entries kept the page and its assets in {id}/{contentDir}/, or only the
+// page as {id}/original.html, and a copy of each revision's HTML next to its
+// version.json. The files are removed only after the new metadata has been
+// written, so an interrupted migration simply runs again.
+func (s *Store) migrate(entry *FileEntry) (*FileEntry, error) {
+	entryDir := filepath.Join(s.baseDir, entry.ID)
+
+	var htmlPath, contentDir string
+	if entry.ContentDir != "" {
+		contentDir = filepath.Join(entryDir, entry.ContentDir)
+		htmlPath = filepath.Join(contentDir, entry.Filename)
+	} else if _, err := os.Stat(filepath.Join(entryDir, "original.html")); err == nil {
+		htmlPath = filepath.Join(entryDir, "original.html")
+	}
+
+	versionFiles, err := s.migrateVersions(entry.ID)
+	if err != nil {
+		return nil, err
+	}
+	if htmlPath == "" {
+		for _, path := range versionFiles {
+			os.Remove(path)
+		}
+		return entry, nil
+	}
+
+	migrated := *entry
+	migrated.ContentDir = ""
+	sha, size, err := s.objects.importFile(htmlPath)
+	if err != nil {
+		return nil, fmt.Errorf("import page: %w", err)
+	}
+	// The stored HTML may differ from the hash in the metadata: older
+	// versions rewrote asset URLs in place without updating it.
+	migrated.SHA256, migrated.Size = sha, size
+
+	if contentDir != "" {
+		err := filepath.WalkDir(contentDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || path == htmlPath ||
+				(filepath.Dir(path) == contentDir && isAtomicTemp(d.Name())) {
+				return err
+			}
+			rel, err := filepath.Rel(contentDir, path)
+			if err != nil {
+				return err
+			}
+			sha, _, err := s.objects.importFile(path)
+			if err != nil {
+				return fmt.Errorf("import asset %s: %w", rel, err)
+			}
+			if migrated.Assets == nil {
+				migrated.Assets = make(map[string]string)
+			}
+			migrated.Assets[filepath.ToSlash(rel)] = sha
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.writeMeta(&migrated); err != nil {
+		return nil, err
+	}
+
+	if contentDir != "" {
+		os.RemoveAll(contentDir)
+	} else {
+		os.Remove(htmlPath)
+	}
+	for _, path := range versionFiles {
+		os.Remove(path)
+	}
+	log.Printf("Migrated %s to the object store", entry.ID)
+	return &migrated, nil
+}
+
+// migrateVersions moves archived revisions that still have their own copy
+// of the HTML into the object store. It returns the copies, which the
+// caller removes once the entry itself has been migrated.
+func (s *Store) migrateVersions(id string) ([]string, error) {
+	versions, err := s.Versions(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, v := range versions {
+		dir := filepath.Join(s.versionsDir(id), strconv.Itoa(v.Revision))
+		path := filepath.Join(dir, v.Filename)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		sha, size, err := s.objects.importFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("import revision %d: %w", v.Revision, err)
+		}
+		if sha != v.SHA256 || size != v.Size {
+			v.SHA256, v.Size = sha, size
+			meta, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				return nil, fmt.Errorf("marshal version metadata: %w", err)
+			}
+			if err := writeFileAtomic(filepath.Join(dir, "version.json"), meta, 0644); err != nil {
+				return nil, fmt.Errorf("write version metadata: %w", err)
+			}
+		}
+		files = append(files, path)
+	}
+	return files, nil
+}
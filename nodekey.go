@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	nodeKeyFile       = "node.key"
+	trustedKeysFile   = "trusted_keys"
+	pairedSendersFile = "paired_senders"
+)
+
+// loadOrCreateNodeKey loads this machine's Ed25519 identity key, which
+// signs discovery replies and requests, generating it on first use.
+func loadOrCreateNodeKey(dataDir string) (ed25519.PrivateKey, error) {
+	key, err := loadOrCreatePrivateKey(filepath.Join(dataDir, nodeKeyFile), func() (any, error) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("parse %s: not an Ed25519 key", nodeKeyFile)
+	}
+	return priv, nil
+}
+
+// loadOrCreatePrivateKey reads a PEM-encoded PKCS #8 private key from path,
+// or creates one with generate and saves it there, readable only by the
+// owner.
+func loadOrCreatePrivateKey(path string, generate func() (any, error)) (any, error) {
+	name := filepath.Base(path)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("parse %s: no PEM block", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+
+	key, err := generate()
+	if err != nil {
+		return nil, fmt.Errorf("generate %s: %w", name, err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal %s: %w", name, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("write %s: %w", name, err)
+	}
+	return key, nil
+}
+
+func publicKeyHex(priv ed25519.PrivateKey) string {
+	return hex.EncodeToString(priv.Public().(ed25519.PublicKey))
+}
+
+// signedBytes is what a receiver signs in a discovery reply: the client's
+// nonce and the fields a client acts on. The TLS fingerprint is included,
+// so a verified reply also vouches for the certificate behind the address.
+func (a announcement) signedBytes(nonce string) []byte {
+	return []byte(strings.Join([]string{
+		"distrib-discovery-v1",
+		nonce,
+		a.Name,
+		strconv.Itoa(a.Port),
+		a.Fingerprint,
+		a.Key,
+		strings.Join(a.Tags, ","),
+	}, "\n"))
+}
+
+func (a *announcement) sign(priv ed25519.PrivateKey, nonce string) {
+	a.Sig = hex.EncodeToString(ed25519.Sign(priv, a.signedBytes(nonce)))
+}
+
+// verify reports whether a carries a valid signature by its own key for
+// nonce.
+func (a announcement) verify(nonce string) bool {
+	if nonce == "" || a.Key == "" || a.Sig == "" {
+		return false
+	}
+	pub, err := hex.DecodeString(a.Key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := hex.DecodeString(a.Sig)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, a.signedBytes(nonce), sig)
+}
+
+// TrustedKeys is a list of node keys, one "key name" pair per line. A
+// client keeps the receivers it pushes to in <data>/trusted_keys, and a
+// receiver the senders it has paired with in <data>/paired_senders.
+type TrustedKeys struct {
+	path string
+
+	mu   sync.Mutex
+	keys map[string]string // key -> name
+}
+
+func LoadTrustedKeys(dataDir string) (*TrustedKeys, error) {
+	return loadKeyList(filepath.Join(dataDir, trustedKeysFile))
+}
+
+func LoadPairedSenders(dataDir string) (*TrustedKeys, error) {
+	return loadKeyList(filepath.Join(dataDir, pairedSendersFile))
+}
+
+func loadKeyList(path string) (*TrustedKeys, error) {
+	t := &TrustedKeys{path: path, keys: make(map[string]string)}
+
+	f, err := os.Open(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", filepath.Base(path), err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, name, _ := strings.Cut(line, " ")
+		t.keys[strings.ToLower(key)] = strings.TrimSpace(name)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", filepath.Base(path), err)
+	}
+	return t, nil
+}
+
+func (t *TrustedKeys) Has(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.keys[strings.ToLower(key)]
+	return key != "" && ok
+}
+
+// Name returns the name key was added under, or "" if it isn't listed.
+func (t *TrustedKeys) Name(key string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.keys[strings.ToLower(key)]
+}
+
+// Named returns the keys listed under name, which is compared without
+// regard to case.
+func (t *TrustedKeys) Named(name string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var keys []string
+	for k, n := range t.keys {
+		if strings.EqualFold(n, name) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Add trusts key under name and saves the list.
+func (t *TrustedKeys) Add(key, name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys[strings.ToLower(key)] = name
+
+	keys := make([]string, 0, len(t.keys))
+	for k := range t.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s %s\n", k, t.keys[k])
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return fmt.Errorf("create data dir: %w", err)
+	}
+	if err := writeFileAtomic(t.path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", filepath.Base(t.path), err)
+	}
+	return nil
+}
+
+// Trusted reports whether p may be pushed to without approval: its
+// discovery reply was signed by a trusted key.
+func (t *TrustedKeys) Trusted(p Peer) bool {
+	return p.Verified && t.Has(p.Key)
+}
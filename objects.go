@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// objectStore keeps file contents in {data}/objects/ab/cdef..., named by
+// their SHA256, so identical pages and assets are stored once. Reference
+// counts are kept in memory and rebuilt from the entries' metadata at
+// startup; a blob is removed when its last reference is released.
+type objectStore struct {
+	dir    string
+	tmpDir string
+
+	mu   sync.Mutex
+	refs map[string]int
+	size int64 // bytes in dir, counted at startup and kept up to date
+}
+
+func newObjectStore(dataDir, tmpDir string) (*objectStore, error) {
+	dir := filepath.Join(dataDir, "objects")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create objects dir: %w", err)
+	}
+	o := &objectStore{dir: dir, tmpDir: tmpDir, refs: make(map[string]int)}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if info, err := d.Info(); err == nil {
+			o.size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read objects dir: %w", err)
+	}
+	return o, nil
+}
+
+// diskUsage returns the total size of the stored blobs.
+func (o *objectStore) diskUsage() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.size
+}
+
+// remove deletes a blob file. The caller holds o.mu.
+func (o *objectStore) remove(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if os.Remove(path) == nil {
+		o.size -= info.Size()
+	}
+}
+
+func (o *objectStore) path(sha string) string {
+	if len(sha) < 3 {
+		return filepath.Join(o.dir, "invalid")
+	}
+	return filepath.Join(o.dir, sha[:2], sha[2:])
+}
+
+// acquire stores a finished upload, unless a blob with the same content
+// exists already, and takes a reference to it.
+func (o *objectStore) acquire(u *Upload) (string, error) {
+	sha := u.SHA256()
+	path := o.path(sha)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", fmt.Errorf("create object dir: %w", err)
+		}
+		if err := u.moveTo(path); err != nil {
+			return "", fmt.Errorf("write object: %w", err)
+		}
+		o.size += u.Size()
+	} else if err != nil {
+		return "", fmt.Errorf("stat object: %w", err)
+	}
+	o.refs[sha]++
+	return sha, nil
+}
+
+// retain takes another reference to a blob that is already stored.
+func (o *objectStore) retain(sha string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.refs[sha]++
+}
+
+// release drops a reference and removes the blob when it was the last one.
+func (o *objectStore) release(sha string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.refs[sha]--
+	if o.refs[sha] > 0 {
+		return
+	}
+	delete(o.refs, sha)
+	o.remove(o.path(sha))
+}
+
+// importFile copies an existing file into the store without taking a
+// reference; it is used to migrate older layouts at startup. The file is
+// hard-linked when possible.
+func (o *objectStore) importFile(path string) (string, int64, error) {
+	size, sha, err := hashFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	dst := o.path(sha)
+	if _, err := os.Stat(dst); err == nil {
+		return sha, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", 0, fmt.Errorf("create object dir: %w", err)
+	}
+	if os.Link(path, dst) == nil {
+		o.added(size)
+		return sha, size, nil
+	}
+
+	tmp, err := os.CreateTemp(o.tmpDir, "import-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("create temp file: %w", err)
+	}
+	u := &Upload{f: tmp}
+	defer u.Discard()
+	src, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+	if _, err := io.Copy(tmp, src); err != nil {
+		return "", 0, fmt.Errorf("copy %s: %w", path, err)
+	}
+	if err := u.moveTo(dst); err != nil {
+		return "", 0, fmt.Errorf("write object: %w", err)
+	}
+	o.added(size)
+	return sha, size, nil
+}
+
+func (o *objectStore) added(size int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.size += size
+}
+
+// gc removes blobs that no entry or revision references, along with temp
+// files left by interrupted writes. Files modified within grace are kept,
+// since another process may be about to reference them.
+func (o *objectStore) gc(grace time.Duration, dryRun bool) (removed int, freed int64, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	err = filepath.WalkDir(o.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(o.dir, path)
+		sha := filepath.Dir(rel) + filepath.Base(rel)
+		if o.refs[sha] > 0 {
+			return nil
+		}
+		if time.Since(info.ModTime()) < grace {
+			return nil
+		}
+
+		removed++
+		freed += info.Size()
+		if !dryRun {
+			o.remove(path)
+		}
+		return nil
+	})
+
+	if !dryRun {
+		// Drop shard directories that are now empty; Remove fails on the
+		// others.
+		shards, _ := os.ReadDir(o.dir)
+		for _, d := range shards {
+			if d.IsDir() {
+				os.Remove(filepath.Join(o.dir, d.Name()))
+			}
+		}
+	}
+	return removed, freed, err
+}
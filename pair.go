@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pairCodeTTL is how long a pairing code can be entered.
+	pairCodeTTL = 2 * time.Minute
+
+	// pairMaxPending bounds the pairings waiting for a code.
+	pairMaxPending = 16
+
+	// pairCodeBits is how many bits of the code are checked, one per
+	// round: enough for any six-digit code.
+	pairCodeBits = 20
+)
+
+// A pairing exchanges node keys between a sender and a receiver. The
+// sender posts its key to /pair and gets the receiver's back, and the
+// receiver shows a random six-digit code to whoever is in front of it.
+// The user enters the code on the sender, and the two sides then check
+// that they hold the same code one bit per round: each commits to its bit,
+// bound to both keys, before either reveals it. A machine in between that
+// swapped the keys has to commit to every bit before learning it, so it
+// gets one in a million tries per attempt, and the code never crosses the
+// network where it could be guessed offline.
+type pairing struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Addr    string    `json:"addr"`
+	Code    string    `json:"code"`
+	Expires time.Time `json:"expires"`
+
+	key    string
+	round  int    // rounds of the code checked so far
+	commit string // the sender's commitment for this round
+	nonce  string // the receiver's nonce for this round
+}
+
+type pairStartRequest struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type pairStartResponse struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type pairCommitRequest struct {
+	Round  int    `json:"round"`
+	Commit string `json:"commit"`
+}
+
+type pairCommitResponse struct {
+	Commit string `json:"commit"`
+}
+
+type pairRevealRequest struct {
+	Round int    `json:"round"`
+	Nonce string `json:"nonce"`
+}
+
+type pairRevealResponse struct {
+	Nonce  string `json:"nonce"`
+	Paired bool   `json:"paired"` // this was the last round
+}
+
+// Pairings holds the pairings a receiver is waiting on.
+type Pairings struct {
+	name    string
+	key     string // the receiver's node key
+	paired  *TrustedKeys
+	broker  *SSEBroker
+	mu      sync.Mutex
+	pending map[string]*pairing
+}
+
+func NewPairings(name string, nodeKey ed25519.PrivateKey, paired *TrustedKeys, broker *SSEBroker) *Pairings {
+	return &Pairings{
+		name:    name,
+		key:     publicKeyHex(nodeKey),
+		paired:  paired,
+		broker:  broker,
+		pending: make(map[string]*pairing),
+	}
+}
+
+// start records a pairing request and returns it with a fresh code.
+func (p *Pairings) start(name, key, addr string) (*pairing, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, pr := range p.pending {
+		if time.Now().After(pr.Expires) {
+			delete(p.pending, id)
+		}
+	}
+	if len(p.pending) >= pairMaxPending {
+		return nil, errTooManyPairings
+	}
+	if p.nameTaken(name, key) {
+		return nil, errNameTaken
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return nil, err
+	}
+	var id [8]byte
+	rand.Read(id[:])
+
+	pr := &pairing{
+		ID:      hex.EncodeToString(id[:]),
+		Name:    name,
+		Addr:    addr,
+		Code:    fmt.Sprintf("%06d", n.Int64()),
+		Expires: time.Now().Add(pairCodeTTL),
+		key:     key,
+	}
+	p.pending[pr.ID] = pr
+	snapshot := *pr
+	return &snapshot, nil
+}
+
+// commit takes the sender's commitment for a round of pairing id and
+// returns the receiver's.
+func (p *Pairings) commit(id string, round int, commit string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr := p.get(id)
+	if pr == nil {
+		return "", errPairingNotFound
+	}
+	if round != pr.round || pr.commit != "" {
+		delete(p.pending, id)
+		return "", errPairOutOfOrder
+	}
+	pr.commit = strings.ToLower(commit)
+	pr.nonce = newPairNonce()
+	return pairCommit("receiver", p.key, pr.key, round, pr.nonce, pairCodeBit(pr.Code, round)), nil
+}
+
+// reveal checks the sender's nonce for a round of pairing id against its
+// commitment and this side's bit of the code, and returns the receiver's
+// nonce. After the last round, the sender is paired. The returned pairing
+// is nil until then.
+func (p *Pairings) reveal(id string, round int, nonce string) (string, *pairing, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr := p.get(id)
+	if pr == nil {
+		return "", nil, errPairingNotFound
+	}
+	if round != pr.round || pr.commit == "" {
+		delete(p.pending, id)
+		return "", nil, errPairOutOfOrder
+	}
+	want := pairCommit("sender", pr.key, p.key, round, strings.ToLower(nonce), pairCodeBit(pr.Code, round))
+	if !hmac.Equal([]byte(want), []byte(pr.commit)) {
+		// A new attempt gets a new code, so each try at guessing one
+		// starts over and shows up on this machine.
+		delete(p.pending, id)
+		return "", nil, errWrongCode
+	}
+	reply := pr.nonce
+	pr.round, pr.commit, pr.nonce = pr.round+1, "", ""
+	if pr.round < pairCodeBits {
+		return reply, nil, nil
+	}
+
+	delete(p.pending, id)
+	// Another sender may have paired under the same name since start.
+	if p.nameTaken(pr.Name, pr.key) {
+		return "", nil, errNameTaken
+	}
+	if err := p.paired.Add(pr.key, pr.Name); err != nil {
+		return "", nil, err
+	}
+	return reply, pr, nil
+}
+
+// reject drops pairing id.
+func (p *Pairings) reject(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.get(id) == nil {
+		return errPairingNotFound
+	}
+	delete(p.pending, id)
+	return nil
+}
+
+// get returns pending pairing id, dropping it if it expired. The caller
+// holds p.mu.
+func (p *Pairings) get(id string) *pairing {
+	pr := p.pending[id]
+	if pr != nil && time.Now().After(pr.Expires) {
+		delete(p.pending, id)
+		return nil
+	}
+	return pr
+}
+
+// nameTaken reports whether a sender other than key is paired under name.
+// acl.conf rules refer to senders by these names, so each must be unique.
+func (p *Pairings) nameTaken(name, key string) bool {
+	for _, k := range p.paired.Named(name) {
+		if k != key {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the pairings waiting for a code, oldest first.
+func (p *Pairings) list() []*pairing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := []*pairing{}
+	for _, pr := range p.pending {
+		if time.Now().Before(pr.Expires) {
+			snapshot := *pr
+			list = append(list, &snapshot)
+		}
+	}
+	slices.SortFunc(list, func(a, b *pairing) int { return a.Expires.Compare(b.Expires) })
+	return list
+}
+
+var (
+	errPairingNotFound = errors.New("no such pairing, or it expired or was rejected")
+	errPairOutOfOrder  = errors.New("pairing steps out of order")
+	errWrongCode       = errors.New("wrong code")
+	errTooManyPairings = errors.New("too many pairings in progress")
+	errNameTaken       = errors.New("another sender is already paired under this name; pair with a different -name")
+)
+
+func newPairNonce() string {
+	var b [32]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// pairCommit is one side's commitment to its bit of the code in a round.
+// It is bound to the committing side's key, then the other side's, so it
+// can't be replayed in a pairing between other keys.
+func pairCommit(role, from, to string, round int, nonce string, bit uint) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "distrib-pair-v3 %s\n%s\n%s\n%d\n%s\n%d",
+		role, strings.ToLower(from), strings.ToLower(to), round, nonce, bit))
+	return hex.EncodeToString(sum[:])
+}
+
+// pairCodeBit returns bit round of a six-digit code.
+func pairCodeBit(code string, round int) uint {
+	n, _ := strconv.Atoi(code)
+	return uint(n>>round) & 1
+}
+
+// parsePairCode keeps the digits of a code as typed, as in "123 456".
+func parsePairCode(s string) (string, error) {
+	code := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+	if len(code) != 6 {
+		return "", errors.New("the code has six digits")
+	}
+	return code, nil
+}
+
+// formatPairCode splits a code for reading out, as "123 456".
+func formatPairCode(code string) string {
+	return code[:3] + " " + code[3:]
+}
+
+func validNodeKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	return err == nil && len(b) == ed25519.PublicKeySize
+}
+
+// handlePairStart begins pairing with a sender and shows the code on this
+// machine: in the log, and in the web UI through an event that carries
+// no code (the UI fetches it from /pair, which only answers loopback).
+func handlePairStart(p *Pairings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req pairStartRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+			jsonError(w, "parse request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Key = strings.ToLower(req.Key)
+		if !validNodeKey(req.Key) {
+			jsonError(w, "invalid key", http.StatusBadRequest)
+			return
+		}
+		// Names end up in paired_senders, one per line.
+		req.Name = strings.Join(strings.Fields(req.Name), " ")
+		if req.Name == "" {
+			req.Name = "unknown"
+		}
+		if len(req.Name) > 64 {
+			req.Name = req.Name[:64]
+		}
+		// acl.conf tells keys and names apart by their form.
+		if req.Name == "*" || validNodeKey(req.Name) {
+			jsonError(w, "invalid name", http.StatusBadRequest)
+			return
+		}
+
+		pr, err := p.start(req.Name, req.Key, r.RemoteAddr)
+		switch {
+		case errors.Is(err, errNameTaken):
+			jsonError(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, errTooManyPairings):
+			jsonError(w, err.Error(), http.StatusTooManyRequests)
+			return
+		case err != nil:
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Pairing request from %q (%s). Code: %s", pr.Name, pr.Addr, formatPairCode(pr.Code))
+		log.Printf("Enter the code on the sender to pair. It expires in %s.", pairCodeTTL)
+		p.broker.PublishPairRequest(pr.ID, pr.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pairStartResponse{ID: pr.ID, Name: p.name, Key: p.key})
+	}
+}
+
+// handlePairCommit answers the sender's commitment for a round with the
+// receiver's.
+func handlePairCommit(p *Pairings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req pairCommitRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+			jsonError(w, "parse request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if b, err := hex.DecodeString(req.Commit); err != nil || len(b) != sha256.Size {
+			jsonError(w, "invalid commitment", http.StatusBadRequest)
+			return
+		}
+
+		id := r.PathValue("id")
+		commit, err := p.commit(id, req.Round, req.Commit)
+		if err != nil {
+			pairError(w, p, id, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pairCommitResponse{Commit: commit})
+	}
+}
+
+// handlePairReveal checks the sender's nonce for a round and answers with
+// the receiver's. After the last round, the sender is paired.
+func handlePairReveal(p *Pairings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req pairRevealRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+			jsonError(w, "parse request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id := r.PathValue("id")
+		nonce, pr, err := p.reveal(id, req.Round, req.Nonce)
+		if err != nil {
+			pairError(w, p, id, err)
+			return
+		}
+		if pr != nil {
+			log.Printf("Paired with %q (%s)", pr.Name, pr.Addr)
+			p.broker.PublishPairDone(pr.ID)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pairRevealResponse{Nonce: nonce, Paired: pr != nil})
+	}
+}
+
+// pairError answers a pairing step that failed. Failures other than an
+// unknown pairing end it, so the web UI drops its code.
+func pairError(w http.ResponseWriter, p *Pairings, id string, err error) {
+	if !errors.Is(err, errPairingNotFound) {
+		log.Printf("Pairing %s failed: %v", id, err)
+		p.broker.PublishPairDone(id)
+	}
+	switch {
+	case errors.Is(err, errPairingNotFound):
+		jsonError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errWrongCode):
+		jsonError(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errPairOutOfOrder), errors.Is(err, errNameTaken):
+		jsonError(w, err.Error(), http.StatusConflict)
+	default:
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handlePairReject drops a pairing the user didn't ask for, from this
+// machine only.
+func handlePairReject(p *Pairings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isLocalUI(r) {
+			jsonError(w, "pairings can only be rejected in the receiver's web UI", http.StatusForbidden)
+			return
+		}
+		id := r.PathValue("id")
+		if err := p.reject(id); err != nil {
+			jsonError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		log.Printf("Pairing %s rejected", id)
+		p.broker.PublishPairDone(id)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"ok": true})
+	}
+}
+
+// handlePairList returns the pairings waiting for a code with their codes,
+// to the web UI on this machine only: a page that could read them could
+// pair itself.
+func handlePairList(p *Pairings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isLocalUI(r) {
+			jsonError(w, "pairing codes are only shown in the receiver's web UI", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.list())
+	}
+}
+
+func cmdPair(args []string) {
+	fs := flag.NewFlagSet("pair", flag.ExitOnError)
+	target := fs.String("target", "", "Receiver address (host:port or [ipv6]:port), skips discovery")
+	disc := addDiscoveryFlags(fs)
+	dataDir := fs.String("data", "", "Data directory (default: ~/.distrib)")
+	keyFlag := fs.String("key", "", "Shared key for signing requests (default: contents of <data>/secret.key)")
+	insecure := fs.Bool("insecure", false, "Use plain HTTP instead of TLS (for older receivers)")
+	name := fs.String("name", "", "Name to pair as (default: hostname)")
+	fs.Parse(args)
+
+	if err := disc.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if (*target == "") == (fs.NArg() == 0) {
+		fmt.Fprintln(os.Stderr, "Usage: distrib pair <receiver name> [flags], or distrib pair -target <host:port>")
+		os.Exit(1)
+	}
+
+	if *name == "" {
+		*name, _ = os.Hostname()
+		if *name == "" {
+			*name = "unknown"
+		}
+	}
+
+	c, err := loadClient(resolveDataDir(*dataDir), *keyFlag, *insecure)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	trusted, err := LoadTrustedKeys(resolveDataDir(*dataDir))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var peer Peer
+	if *target != "" {
+		addr, err := targetAddr(*target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		peer = Peer{Name: *target, Addr: addr}
+	} else {
+		fmt.Println("Discovering peers...")
+		peers, err := discover(disc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: discovery failed: %v\n", err)
+			os.Exit(1)
+		}
+		var matches []Peer
+		for _, p := range peers {
+			if strings.EqualFold(p.Name, fs.Arg(0)) {
+				matches = append(matches, p)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			fmt.Fprintf(os.Stderr, "No receiver named %q found.\n", fs.Arg(0))
+			os.Exit(1)
+		case 1:
+			peer = matches[0]
+		default:
+			fmt.Fprintf(os.Stderr, "%d receivers are named %q; use -target with one of:\n", len(matches), fs.Arg(0))
+			for _, p := range matches {
+				fmt.Fprintf(os.Stderr, "  %s\n", p.Addr)
+			}
+			os.Exit(1)
+		}
+		c.addPeers([]Peer{peer})
+	}
+
+	if err := pair(c, trusted, peer, *name, os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// pair runs the sender's side of pairing with peer, asking for the code
+// the receiver shows.
+func pair(c *client, trusted *TrustedKeys, peer Peer, name string, in io.Reader, out io.Writer) error {
+	self := publicKeyHex(c.node)
+
+	var start pairStartResponse
+	err := c.doJSON(http.MethodPost, peer.Addr, "/pair", pairStartRequest{Name: name, Key: self}, &start)
+	var se *statusError
+	if errors.As(err, &se) && (se.Code == http.StatusNotFound || se.Code == http.StatusMethodNotAllowed) {
+		return fmt.Errorf("%s is too old to pair", peer.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("start pairing: %w", err)
+	}
+	start.Key = strings.ToLower(start.Key)
+	if !validNodeKey(start.Key) {
+		return errors.New("receiver sent an invalid key")
+	}
+	if peer.Verified && peer.Key != start.Key {
+		return errors.New("receiver's key differs from the one it announced")
+	}
+
+	fmt.Fprintf(out, "Enter the code shown on %s (in its log and web UI): ", start.Name)
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("no code: %w", err)
+	}
+	code, err := parsePairCode(line)
+	if err != nil {
+		return err
+	}
+
+	for round := range pairCodeBits {
+		bit := pairCodeBit(code, round)
+		nonce := newPairNonce()
+
+		var theirs pairCommitResponse
+		err := c.doJSON(http.MethodPost, peer.Addr, "/pair/"+start.ID+"/commit",
+			pairCommitRequest{Round: round, Commit: pairCommit("sender", self, start.Key, round, nonce, bit)}, &theirs)
+		if err != nil {
+			return pairStepError(start.Name, err)
+		}
+		var revealed pairRevealResponse
+		err = c.doJSON(http.MethodPost, peer.Addr, "/pair/"+start.ID+"/reveal",
+			pairRevealRequest{Round: round, Nonce: nonce}, &revealed)
+		if err != nil {
+			return pairStepError(start.Name, err)
+		}
+
+		want := pairCommit("receiver", start.Key, self, round, strings.ToLower(revealed.Nonce), bit)
+		if !hmac.Equal([]byte(want), []byte(strings.ToLower(theirs.Commit))) {
+			return fmt.Errorf("%s does not hold the code you entered; a machine in between may be swapping keys. Not pairing", start.Name)
+		}
+		if revealed.Paired != (round == pairCodeBits-1) {
+			return fmt.Errorf("%s ended pairing early", start.Name)
+		}
+	}
+
+	if err := trusted.Add(start.Key, start.Name); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Paired with %s (key %s).\n", start.Name, start.Key)
+	return nil
+}
+
+// pairStepError explains why a round of pairing was refused.
+func pairStepError(receiver string, err error) error {
+	var se *statusError
+	switch {
+	case errors.As(err, &se) && se.Code == http.StatusForbidden:
+		return errors.New("wrong code; check it and run distrib pair again for a new one")
+	case errors.As(err, &se) && se.Code == http.StatusNotFound:
+		return fmt.Errorf("%s rejected the pairing, or it expired; run distrib pair again", receiver)
+	}
+	return fmt.Errorf("pairing: %w", err)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// runPairing plays the sender's side of the rounds against p with code,
+// and returns the error from the first round that fails.
+func runPairing(t *testing.T, p *Pairings, id, senderKey, code string) (*pairing, error) {
+	t.Helper()
+	for round := range pairCodeBits {
+		bit := pairCodeBit(code, round)
+		nonce := newPairNonce()
+		theirs, err := p.commit(id, round, pairCommit("sender", senderKey, p.key, round, nonce, bit))
+		if err != nil {
+			return nil, err
+		}
+		revealed, pr, err := p.reveal(id, round, nonce)
+		if err != nil {
+			return nil, err
+		}
+		if want := pairCommit("receiver", p.key, senderKey, round, revealed, bit); want != theirs {
+			t.Fatalf("round %d: receiver's commitment doesn't open to the same bit", round)
+		}
+		if (pr != nil) != (round == pairCodeBits-1) {
+			t.Fatalf("round %d: paired = %v", round, pr != nil)
+		}
+		if pr != nil {
+			return pr, nil
+		}
+	}
+	return nil, nil
+}
+
+func newTestPairings(t *testing.T) *Pairings {
+	t.Helper()
+	_, nodeKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paired, err := LoadPairedSenders(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewPairings("receiver", nodeKey, paired, NewSSEBroker())
+}
+
+func TestPairingWithShownCode(t *testing.T) {
+	p := newTestPairings(t)
+	senderKey := strings.Repeat("ab", 32)
+
+	pr, err := p.start("laptop", senderKey, "192.0.2.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsePairCode(pr.Code); err != nil {
+		t.Fatalf("code %q: %v", pr.Code, err)
+	}
+
+	done, err := runPairing(t, p, pr.ID, senderKey, pr.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done == nil || done.Name != "laptop" {
+		t.Fatalf("pairing ended with %+v", done)
+	}
+	if p.paired.Name(senderKey) != "laptop" {
+		t.Error("sender was not added to paired_senders")
+	}
+	if len(p.list()) != 0 {
+		t.Error("a finished pairing is still listed")
+	}
+}
+
+func TestPairingWithWrongCode(t *testing.T) {
+	p := newTestPairings(t)
+	senderKey := strings.Repeat("ab", 32)
+
+	pr, err := p.start("laptop", senderKey, "192.0.2.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Off by one in the lowest bit, which is checked first.
+	n, _ := strconv.Atoi(pr.Code)
+	wrong := fmt.Sprintf("%06d", n^1)
+
+	if _, err := runPairing(t, p, pr.ID, senderKey, wrong); !errors.Is(err, errWrongCode) {
+		t.Fatalf("got %v, want %v", err, errWrongCode)
+	}
+	if p.paired.Has(senderKey) {
+		t.Error("sender with a wrong code was paired")
+	}
+	// The pairing is gone, so the code can't be guessed bit by bit.
+	if _, err := p.commit(pr.ID, 0, strings.Repeat("00", 32)); !errors.Is(err, errPairingNotFound) {
+		t.Errorf("pairing still open after a wrong code: %v", err)
+	}
+}
+
+func TestPairingOutOfOrder(t *testing.T) {
+	p := newTestPairings(t)
+	senderKey := strings.Repeat("ab", 32)
+
+	pr, err := p.start("laptop", senderKey, "192.0.2.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Revealing before committing would let the sender pick its bit after
+	// seeing the receiver's.
+	if _, _, err := p.reveal(pr.ID, 0, newPairNonce()); !errors.Is(err, errPairOutOfOrder) {
+		t.Fatalf("got %v, want %v", err, errPairOutOfOrder)
+	}
+	if _, err := p.commit(pr.ID, 0, strings.Repeat("00", 32)); !errors.Is(err, errPairingNotFound) {
+		t.Errorf("pairing still open after a step out of order: %v", err)
+	}
+}
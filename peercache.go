@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	peerCacheFile   = "peers.json"
+	staticPeersFile = "peers.conf"
+
+	defaultPeerCacheTTL = 7 * 24 * time.Hour
+)
+
+// peerCache remembers the receivers discovery has found, with when each was
+// last seen, so a push can start without waiting for discovery.
+type peerCache struct {
+	path  string
+	peers []cachedPeer
+}
+
+type cachedPeer struct {
+	Peer
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func loadPeerCache(dataDir string) (*peerCache, error) {
+	pc := &peerCache{path: filepath.Join(dataDir, peerCacheFile)}
+
+	data, err := os.ReadFile(pc.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return pc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read peer cache: %w", err)
+	}
+	if err := json.Unmarshal(data, &pc.peers); err != nil {
+		return nil, fmt.Errorf("parse peer cache: %w", err)
+	}
+	return pc, nil
+}
+
+// fresh returns the peers seen within ttl.
+func (pc *peerCache) fresh(ttl time.Duration) []Peer {
+	var peers []Peer
+	for _, cp := range pc.peers {
+		if time.Since(cp.LastSeen) <= ttl {
+			peers = append(peers, cp.Peer)
+		}
+	}
+	return peers
+}
+
+// seen records discovered peers as seen now, replacing what was known
+// about their addresses.
+func (pc *peerCache) seen(peers ...Peer) {
+	now := time.Now()
+	for _, p := range peers {
+		if i := pc.find(p.Addr); i >= 0 {
+			pc.peers[i] = cachedPeer{Peer: p, LastSeen: now}
+		} else {
+			pc.peers = append(pc.peers, cachedPeer{Peer: p, LastSeen: now})
+		}
+	}
+}
+
+// touch marks a cached peer as seen now, after a successful push.
+func (pc *peerCache) touch(addr string) {
+	if i := pc.find(addr); i >= 0 {
+		pc.peers[i].LastSeen = time.Now()
+	}
+}
+
+func (pc *peerCache) find(addr string) int {
+	for i, cp := range pc.peers {
+		if cp.Addr == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// save writes the cache, dropping peers not seen within ttl.
+func (pc *peerCache) save(ttl time.Duration) error {
+	kept := pc.peers[:0]
+	for _, cp := range pc.peers {
+		if time.Since(cp.LastSeen) <= ttl {
+			kept = append(kept, cp)
+		}
+	}
+	pc.peers = kept
+
+	data, err := json.MarshalIndent(pc.peers, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pc.path), 0755); err != nil {
+		return fmt.Errorf("create data dir: %w", err)
+	}
+	return writeFileAtomic(pc.path, data, 0644)
+}
+
+// loadStaticPeers reads <data>/peers.conf, which lists receivers that are
+// always pushed to, one "name address" pair per line:
+//
+//	# name        address
+//	living-room   192.168.1.50:9848
+//	wsl-box       [fe80::1%eth0]:9848
+func loadStaticPeers(dataDir string) ([]Peer, error) {
+	path := filepath.Join(dataDir, staticPeersFile)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open static peers: %w", err)
+	}
+	defer f.Close()
+
+	var peers []Peer
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"name address\"", path, n)
+		}
+		addr, err := targetAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		peers = append(peers, Peer{Name: fields[0], Addr: addr})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read static peers: %w", err)
+	}
+	return peers, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// peerStatus is one line of `distrib peers`.
+type peerStatus struct {
+	Name      string   `json:"name"`
+	Addr      string   `json:"addr"`
+	Version   string   `json:"version,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Key       string   `json:"key,omitempty"`
+	Trust     string   `json:"trust"` // trusted, untrusted (signed by an unknown key) or unsigned
+	Files     int      `json:"files"`
+	DiskUsage int64    `json:"disk_usage"`
+	LatencyMS float64  `json:"latency_ms"`
+	Error     string   `json:"error,omitempty"`
+}
+
+func cmdPeers(args []string) {
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	disc := addDiscoveryFlags(fs)
+	dataDir := fs.String("data", "", "Data directory (default: ~/.distrib)")
+	insecure := fs.Bool("insecure", false, "Use plain HTTP instead of TLS (for older receivers)")
+	requestTimeout := fs.Duration("request-timeout", 5*time.Second, "Give up on a peer's health check after this long")
+	jsonOut := fs.Bool("json", false, "Print JSON instead of a table")
+	watch := fs.Bool("watch", false, "Keep discovering and probing until interrupted")
+	interval := fs.Duration("interval", 5*time.Second, "Time between refreshes with -watch")
+	fs.Parse(args)
+
+	if err := disc.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	c, err := loadClient(resolveDataDir(*dataDir), "", *insecure)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	c.timeout = *requestTimeout
+
+	trusted, err := LoadTrustedKeys(resolveDataDir(*dataDir))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	cache, err := loadPeerCache(resolveDataDir(*dataDir))
+	if err != nil {
+		cache = &peerCache{path: filepath.Join(resolveDataDir(*dataDir), peerCacheFile)}
+	}
+
+	info, err := os.Stdout.Stat()
+	clear := *watch && !*jsonOut && err == nil && info.Mode()&os.ModeCharDevice != 0
+
+	for {
+		peers, err := discover(disc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: discovery failed: %v\n", err)
+			os.Exit(1)
+		}
+		c.addPeers(peers)
+		cache.seen(peers...)
+		if err := cache.save(defaultPeerCacheTTL); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: save peer cache: %v\n", err)
+		}
+		statuses := probePeers(c, peers)
+		for i, p := range peers {
+			switch {
+			case trusted.Trusted(p):
+				statuses[i].Trust = "trusted"
+			case p.Verified:
+				statuses[i].Trust = "untrusted"
+			default:
+				statuses[i].Trust = "unsigned"
+			}
+		}
+
+		switch {
+		case *jsonOut && *watch:
+			// One array per line, so each refresh can be read as it arrives.
+			json.NewEncoder(os.Stdout).Encode(statuses)
+		case *jsonOut:
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(statuses)
+		default:
+			if clear {
+				fmt.Print("\033[H\033[2J")
+			}
+			if *watch {
+				fmt.Printf("%s\n\n", time.Now().Format("15:04:05"))
+			}
+			printPeerStatuses(os.Stdout, statuses)
+		}
+
+		if !*watch {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// probePeers fetches every peer's /health in parallel, timing each request.
+func probePeers(c *client, peers []Peer) []peerStatus {
+	statuses := make([]peerStatus, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Go(func() {
+			statuses[i] = probePeer(c, p)
+		})
+	}
+	wg.Wait()
+	return statuses
+}
+
+func probePeer(c *client, p Peer) peerStatus {
+	st := peerStatus{Name: p.Name, Addr: p.Addr, Version: p.Version, Tags: p.Tags, Key: p.Key}
+
+	var health healthResponse
+	start := time.Now()
+	err := c.doJSON(http.MethodGet, p.Addr, "/health", nil, &health)
+	st.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+
+	if health.Name != "" {
+		st.Name = health.Name
+	}
+	if health.Version != "" {
+		st.Version = health.Version
+	}
+	if len(health.Tags) > 0 {
+		st.Tags = health.Tags
+	}
+	st.Files = health.Files
+	st.DiskUsage = health.DiskUsage
+	return st
+}
+
+func printPeerStatuses(out io.Writer, statuses []peerStatus) {
+	if len(statuses) == 0 {
+		fmt.Fprintln(out, "No peers found.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tADDRESS\tTRUST\tVERSION\tFILES\tDISK\tLATENCY\tTAGS")
+	for _, st := range statuses {
+		version := st.Version
+		if version == "" {
+			version = "-"
+		}
+		if st.Error != "" {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t-\t-\t-\tunreachable: %s\n", st.Name, st.Addr, st.Trust, version, st.Error)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%.1f ms\t%s\n",
+			st.Name, st.Addr, st.Trust, version, st.Files, formatBytes(st.DiskUsage), st.LatencyMS, strings.Join(st.Tags, ","))
+	}
+	tw.Flush()
+}
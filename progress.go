@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// peerProgress tracks one peer's push for the live display.
+type peerProgress struct {
+	name  string
+	sent  atomic.Int64
+	total atomic.Int64
+
+	mu     sync.Mutex
+	status string
+}
+
+func (p *peerProgress) setStatus(status string) {
+	p.mu.Lock()
+	p.status = status
+	p.mu.Unlock()
+}
+
+func (p *peerProgress) line() string {
+	p.mu.Lock()
+	status := p.status
+	p.mu.Unlock()
+
+	sent, total := p.sent.Load(), p.total.Load()
+	if total <= 0 {
+		return fmt.Sprintf("  %-20s %s", p.name, status)
+	}
+	pct := min(sent*100/total, 100)
+	const width = 20
+	bar := strings.Repeat("=", int(pct)*width/100) + strings.Repeat(" ", width-int(pct)*width/100)
+	return fmt.Sprintf("  %-20s [%s] %3d%% %9s  %s", p.name, bar, pct, formatBytes(sent), status)
+}
+
+// progressDisplay redraws one line per peer while pushes run. When the
+// output isn't a terminal it stays quiet and only the summary is printed.
+type progressDisplay struct {
+	out   io.Writer
+	peers []*peerProgress
+	live  bool
+	drawn int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newProgressDisplay(peers []*peerProgress) *progressDisplay {
+	info, err := os.Stdout.Stat()
+	live := err == nil && info.Mode()&os.ModeCharDevice != 0
+	return &progressDisplay{out: os.Stdout, peers: peers, live: live}
+}
+
+func (d *progressDisplay) start() {
+	if !d.live {
+		return
+	}
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			d.draw()
+			select {
+			case <-ticker.C:
+			case <-d.stop:
+				d.draw()
+				return
+			}
+		}
+	}()
+}
+
+// finish draws the final state and stops redrawing.
+func (d *progressDisplay) finish() {
+	if !d.live {
+		return
+	}
+	close(d.stop)
+	<-d.done
+}
+
+func (d *progressDisplay) draw() {
+	var b strings.Builder
+	if d.drawn > 0 {
+		fmt.Fprintf(&b, "\033[%dA", d.drawn) // back to the first line
+	}
+	for _, p := range d.peers {
+		b.WriteString("\r\033[K")
+		b.WriteString(p.line())
+		b.WriteString("\n")
+	}
+	d.drawn = len(d.peers)
+	io.WriteString(d.out, b.String())
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
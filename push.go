@@ -1,8 +1,9 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,116 +11,742 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 )
 
 func cmdPush(args []string) {
 	fs := flag.NewFlagSet("push", flag.ExitOnError)
-	target := fs.String("target", "", "Target address (host:port), skips discovery")
-	discoveryPort := fs.Int("discovery-port", defaultDiscoveryPort, "UDP discovery port")
-	timeout := fs.Duration("timeout", 2*time.Second, "Discovery timeout")
+	target := fs.String("target", "", "Target address (host:port or [ipv6]:port), skips discovery")
+	disc := addDiscoveryFlags(fs)
+	dataDir := fs.String("data", "", "Data directory (default: ~/.distrib)")
+	keyFlag := fs.String("key", "", "Shared key for signing requests (default: contents of <data>/secret.key)")
+	insecure := fs.Bool("insecure", false, "Use plain HTTP instead of TLS (for older receivers)")
+	noAssets := fs.Bool("no-assets", false, "Don't upload local files referenced by the page")
+	chunkSizeMB := fs.Int64("chunk-size", 8, "Files larger than this many MB are sent in resumable chunks")
+	force := fs.Bool("force", false, "Upload even if the receiver already has identical content")
+	jobs := fs.Int("jobs", 4, "Number of peers to push to at the same time")
+	requestTimeout := fs.Duration("request-timeout", defaultRequestTimeout, "Give up on a request after this long without progress")
+	retries := fs.Int("retries", 2, "Retries per peer after a network error or server failure")
+	group := fs.String("group", "", "Only push to peers advertising one of these comma-separated tags")
+	to := fs.String("to", "", "Only push to peers whose name matches one of these comma-separated globs or /regexps/")
+	exclude := fs.String("exclude", "", "Skip peers whose name matches one of these comma-separated globs or /regexps/")
+	noCache := fs.Bool("no-cache", false, "Wait for discovery instead of starting with cached and static peers")
+	cacheTTL := fs.Duration("cache-ttl", defaultPeerCacheTTL, "Forget cached peers not seen for this long")
+	pick := fs.Bool("pick", false, "Choose the peers to push to from the discovered list")
+	approveFlag := fs.String("approve", "", "Also push to untrusted peers matching these comma-separated globs or /regexps/, trusting their keys")
+	encrypt := fs.Bool("encrypt", false, "Encrypt the page and assets to each receiver's key (receivers must be trusted, e.g. paired)")
 	fs.Parse(args)
 
+	if err := disc.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	if fs.NArg() < 1 {
 		fmt.Fprintln(os.Stderr, "Usage: distrib push <file.html> [flags]")
 		os.Exit(1)
 	}
 
-	filePath := fs.Arg(0)
+	sel := &peerSelector{tags: parseTags(*group)}
+	var err error
+	if sel.include, err = parsePatterns(*to); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -to: %v\n", err)
+		os.Exit(1)
+	}
+	if sel.exclude, err = parsePatterns(*exclude); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -exclude: %v\n", err)
+		os.Exit(1)
+	}
+	if sel.approve, err = parsePatterns(*approveFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -approve: %v\n", err)
+		os.Exit(1)
+	}
+
+	plan, err := newPushPlan(fs.Arg(0), !*noAssets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	plan.chunkSize = *chunkSizeMB << 20
+	plan.force = *force
+	plan.encrypt = *encrypt
 
-	data, err := os.ReadFile(filePath)
+	c, err := loadClient(resolveDataDir(*dataDir), *keyFlag, *insecure)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: cannot read %s: %v\n", filePath, err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	c.timeout = *requestTimeout
+
+	if plan.state, err = loadUploadState(resolveDataDir(*dataDir)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if sel.trusted, err = LoadTrustedKeys(resolveDataDir(*dataDir)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	plan.trusted = sel.trusted
 
 	hostname, _ := os.Hostname()
 	if hostname == "" {
 		hostname = "unknown"
 	}
+	plan.sender = hostname
 
-	var peers []Peer
-
+	found := &pushPeers{}
 	if *target != "" {
-		peers = []Peer{{Name: *target, Addr: *target}}
-	} else {
-		fmt.Println("Discovering peers...")
-		peers, err = discoverPeers(*discoveryPort, *timeout)
+		addr, err := targetAddr(*target)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: discovery failed: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-
-		if len(peers) == 0 {
+		found.peers = []Peer{{Name: *target, Addr: addr}}
+	} else {
+		found, err = findPushPeers(c, sel, disc, resolveDataDir(*dataDir), !*noCache, *cacheTTL, *pick)
+		if errors.Is(err, errNoPeersFound) {
 			fmt.Fprintln(os.Stderr, "No peers found.")
-			fmt.Fprintln(os.Stderr, "If you're in WSL2, try: distrib push <file> -target <ip:port>")
+			fmt.Fprintf(os.Stderr, "If you're in WSL2, try: distrib push <file> -target <ip:port>, or list receivers in %s\n",
+				filepath.Join(resolveDataDir(*dataDir), staticPeersFile))
 			os.Exit(1)
 		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-		fmt.Printf("Found %d peer(s):\n", len(peers))
-		for i, p := range peers {
-			fmt.Printf("  %d. %s (%s)\n", i+1, p.Name, p.Addr)
+	var results []*pushResult
+	if len(found.peers) > 0 {
+		fmt.Printf("Pushing %s to %d peer(s)...\n", plan.filename, len(found.peers))
+		results = pushToPeers(c, plan, found.peers, max(*jobs, 1), max(*retries, 0))
+	}
+
+	if found.refresh != nil {
+		results = pushToDiscovered(c, plan, sel, found, results, *pick, max(*jobs, 1), max(*retries, 0))
+		if len(results) == 0 {
+			fmt.Fprintln(os.Stderr, "No peers to push to.")
+			os.Exit(1)
 		}
 	}
 
-	filename := filepath.Base(filePath)
+	printPushResults(results)
 
-	for _, peer := range peers {
-		fmt.Printf("Pushing %s to %s... ", filename, peer.Name)
+	if found.cache != nil {
+		savePeerCache(found.cache, results, *cacheTTL)
+	}
 
-		id, err := pushFile(peer.Addr, filename, hostname, data)
+	for _, r := range results {
+		if r.err != nil && !r.stale {
+			os.Exit(1)
+		}
+	}
+}
+
+// newPushPlan hashes the page at path and, when withAssets is set, the local
+// files it references, warning about the ones that are missing.
+func newPushPlan(path string, withAssets bool) (*pushPlan, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+
+	var assets []assetData
+	if withAssets {
+		var missing []string
+		assets, missing, err = findLocalAssets(path)
 		if err != nil {
-			fmt.Printf("FAILED: %v\n", err)
-			continue
+			return nil, fmt.Errorf("cannot read %s: %w", path, err)
+		}
+		if len(missing) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d referenced file(s) not found on disk:\n", len(missing))
+			for _, m := range missing {
+				fmt.Fprintf(os.Stderr, "  %s\n", m)
+			}
 		}
+	}
 
-		fmt.Printf("OK (id: %s)\n", id)
+	_, sha, err := hashFile(path)
+	if err == nil {
+		err = hashAssets(assets)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pushPlan{
+		filename: filepath.Base(path),
+		path:     path,
+		size:     info.Size(),
+		sha256:   sha,
+		assets:   assets,
+	}, nil
 }
 
-func pushFile(addr, filename, sender string, data []byte) (string, error) {
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
+// peerSelector decides which receivers a push goes to: -group, -to and
+// -exclude narrow them down, and untrusted ones need -approve or -pick.
+type peerSelector struct {
+	tags             []string
+	include, exclude []namePattern
+	approve          []namePattern
+	trusted          *TrustedKeys
+	static           []Peer // from peers.conf
+	refreshing       bool   // discovery is still running in the background
+}
+
+// filter applies -group, -to and -exclude, and returns the -to patterns
+// that matched no peer.
+func (s *peerSelector) filter(peers []Peer) ([]Peer, []string) {
+	return filterPeers(filterGroups(peers, s.tags), s.include, s.exclude)
+}
 
-	part, err := writer.CreateFormFile("file", filename)
+// isTrusted reports whether p's key is trusted. Peers listed in peers.conf
+// were named by the user, like -target, so they are trusted by address.
+func (s *peerSelector) isTrusted(p Peer) bool {
+	return s.trusted.Trusted(p) || containsPeer(s.static, p)
+}
+
+func (s *peerSelector) describe(p Peer) string {
+	switch {
+	case s.isTrusted(p):
+		return p.describe()
+	case p.Verified:
+		return p.describe() + " (untrusted)"
+	default:
+		return p.describe() + " (unsigned)"
+	}
+}
+
+// approvePeers drops untrusted peers unless -approve matches them, or all is
+// set because they were picked by hand. The keys of approved peers that
+// signed their reply are remembered.
+func (s *peerSelector) approvePeers(peers []Peer, all bool) []Peer {
+	var ok, skipped, waiting []Peer
+	for _, p := range peers {
+		switch {
+		case s.isTrusted(p):
+			ok = append(ok, p)
+		case s.refreshing && !all && !p.Verified && s.trusted.Has(p.Key):
+			waiting = append(waiting, p)
+		case all || slices.ContainsFunc(s.approve, func(n namePattern) bool { return n.match(p.Name) }):
+			ok = append(ok, p)
+			if !p.Verified {
+				fmt.Printf("Approved unsigned peer %s for this push only\n", p.Name)
+				continue
+			}
+			if err := s.trusted.Add(p.Key, p.Name); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+				continue
+			}
+			fmt.Printf("Trusted %s (key %s)\n", p.Name, p.Key)
+		default:
+			skipped = append(skipped, p)
+		}
+	}
+	if len(waiting) > 0 {
+		fmt.Printf("Waiting for discovery to confirm %d paired peer(s): %s\n", len(waiting), peerNames(waiting))
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(os.Stderr, "Skipping %d untrusted peer(s): %s (use -approve to push to them)\n",
+			len(skipped), peerNames(skipped))
+	}
+	return ok
+}
+
+var errNoPeersFound = errors.New("no peers found")
+
+// pushPeers is who a push goes to before background discovery, if any,
+// reports back.
+type pushPeers struct {
+	peers   []Peer // to push to now
+	listed  []Peer // selected before trust was checked
+	cache   *peerCache
+	refresh chan discoveryResult // background discovery, when started
+}
+
+// findPushPeers lists the receivers to push to. With useCache and known
+// peers it starts with those and leaves discovery running in the
+// background; otherwise it waits for discovery.
+func findPushPeers(c *client, sel *peerSelector, disc *discoveryConfig, dataDir string, useCache bool, cacheTTL time.Duration, pick bool) (*pushPeers, error) {
+	static, err := loadStaticPeers(dataDir)
 	if err != nil {
-		return "", fmt.Errorf("create form file: %w", err)
+		return nil, err
 	}
-	if _, err := part.Write(data); err != nil {
-		return "", fmt.Errorf("write file data: %w", err)
+	sel.static = static
+
+	found := &pushPeers{}
+	found.cache, err = loadPeerCache(dataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v; starting a new one\n", err)
+		found.cache = &peerCache{path: filepath.Join(dataDir, peerCacheFile)}
 	}
 
-	if err := writer.WriteField("sender", sender); err != nil {
-		return "", fmt.Errorf("write sender field: %w", err)
+	var known, peers []Peer
+	if useCache {
+		known = mergePeers(static, found.cache.fresh(cacheTTL))
 	}
+	if len(known) > 0 {
+		found.refresh = make(chan discoveryResult, 1)
+		sel.refreshing = true
+		go func() {
+			peers, err := discover(disc)
+			found.refresh <- discoveryResult{peers, err}
+		}()
+		peers = known
+		if !pick {
+			fmt.Printf("Using %d known peer(s), refreshing discovery in the background:\n", len(peers))
+		}
+	} else {
+		fmt.Println("Discovering peers...")
+		peers, err = discover(disc)
+		if err != nil {
+			return nil, fmt.Errorf("discovery failed: %w", err)
+		}
+		found.cache.seen(peers...)
+		peers = mergePeers(static, peers)
 
-	if err := writer.Close(); err != nil {
-		return "", fmt.Errorf("close multipart: %w", err)
+		if len(peers) == 0 {
+			return nil, errNoPeersFound
+		}
+		if !pick {
+			fmt.Printf("Found %d peer(s):\n", len(peers))
+		}
 	}
 
-	url := fmt.Sprintf("http://%s/receive", addr)
-	resp, err := http.Post(url, writer.FormDataContentType(), &body)
+	c.addPeers(peers)
+	if !pick {
+		for i, p := range peers {
+			fmt.Printf("  %d. %s\n", i+1, sel.describe(p))
+		}
+	}
+
+	total := len(peers)
+	peers, unmatched := sel.filter(peers)
+	for _, pattern := range unmatched {
+		fmt.Fprintf(os.Stderr, "Warning: no peer matches %q\n", pattern)
+	}
+	if len(peers) == 0 && found.refresh == nil {
+		return nil, errors.New("no peers match -group/-to/-exclude")
+	}
+	found.listed = peers
+	if pick {
+		if peers, err = pickPeers(os.Stdin, os.Stdout, peers, sel.describe); err != nil {
+			return nil, err
+		}
+		found.peers = sel.approvePeers(peers, true)
+		return found, nil
+	}
+
+	found.peers = sel.approvePeers(peers, false)
+	if len(found.peers) == 0 && found.refresh == nil {
+		return nil, errors.New("no peers to push to")
+	}
+	if len(found.peers) > 0 && len(found.peers) < total {
+		fmt.Printf("Selected %d peer(s): %s\n", len(found.peers), peerNames(found.peers))
+	}
+	return found, nil
+}
+
+// pushToDiscovered waits for background discovery and pushes to the peers
+// it found or confirmed that weren't pushed to yet, returning all results.
+// Cached peers it missed that also failed are likely gone, so they are
+// marked stale and don't fail the push. With -pick the choice stands.
+func pushToDiscovered(c *client, plan *pushPlan, sel *peerSelector, found *pushPeers, results []*pushResult, pick bool, jobs, retries int) []*pushResult {
+	res := <-found.refresh
+	sel.refreshing = false
+	if res.err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: discovery failed: %v\n", res.err)
+	}
+	found.cache.seen(res.peers...)
+	c.addPeers(res.peers)
+
+	for _, r := range results {
+		if r.err != nil && res.err == nil && !containsPeer(res.peers, r.peer) && !containsPeer(sel.static, r.peer) {
+			r.stale = true
+		}
+	}
+	if pick {
+		return results
+	}
+
+	var more []Peer
+	selected, _ := sel.filter(res.peers)
+	for _, p := range selected {
+		// Cached peers are never verified, so paired receivers skipped
+		// before are pushed to once discovery confirms them.
+		if !containsPeer(found.listed, p) || (!containsPeer(found.peers, p) && sel.isTrusted(p)) {
+			more = append(more, p)
+		}
+	}
+	more = sel.approvePeers(more, false)
+	if len(more) > 0 {
+		fmt.Printf("Discovered or confirmed %d more peer(s), pushing %s...\n", len(more), plan.filename)
+		results = append(results, pushToPeers(c, plan, more, jobs, retries)...)
+	}
+	return results
+}
+
+// savePeerCache records the peers that took the push as recently seen.
+func savePeerCache(cache *peerCache, results []*pushResult, ttl time.Duration) {
+	for _, r := range results {
+		if r.err == nil {
+			cache.touch(r.peer.Addr)
+		}
+	}
+	if err := cache.save(ttl); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: save peer cache: %v\n", err)
+	}
+}
+
+// pushPlan is what a push sends to every peer.
+type pushPlan struct {
+	filename  string
+	sender    string
+	path      string
+	size      int64
+	sha256    string
+	assets    []assetData
+	chunkSize int64
+	force     bool
+	state     *uploadState
+	encrypt   bool
+	sealed    bool         // path and assets are encrypted for one receiver
+	trusted   *TrustedKeys // receivers whose keys may be encrypted to
+}
+
+type pushResult struct {
+	peer     Peer
+	progress *peerProgress
+	upToDate bool
+	summary  string
+	err      error
+	stale    bool // a cached peer that failed and discovery no longer finds
+}
+
+// pushToPeers pushes to all peers using up to jobs workers, retrying each
+// peer after transient failures.
+func pushToPeers(c *client, plan *pushPlan, peers []Peer, jobs, retries int) []*pushResult {
+	results := make([]*pushResult, len(peers))
+	progress := make([]*peerProgress, len(peers))
+	for i, p := range peers {
+		progress[i] = &peerProgress{name: p.Name, status: "waiting"}
+		results[i] = &pushResult{peer: p, progress: progress[i]}
+	}
+
+	display := newProgressDisplay(progress)
+	display.start()
+
+	work := make(chan *pushResult)
+	var wg sync.WaitGroup
+	for range min(jobs, len(peers)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range work {
+				pushWithRetries(c, plan, r, retries)
+			}
+		}()
+	}
+	for _, r := range results {
+		work <- r
+	}
+	close(work)
+	wg.Wait()
+
+	display.finish()
+	return results
+}
+
+// pushWithRetries pushes to one peer, trying again after failures that
+// may be transient. A failed upload may still have been stored, so a retry
+// only sends what the receiver's /check reports missing, and receivers too
+// old to answer it aren't retried.
+func pushWithRetries(c *client, plan *pushPlan, r *pushResult, retries int) {
+	pr := r.progress
+	pc := c.withProgress(func(n int64) { pr.sent.Add(n) })
+
+	for attempt := 0; ; attempt++ {
+		pr.sent.Store(0)
+		upToDate, summary, err := plan.pushTo(pc, r.peer.Addr, pr, attempt > 0)
+		if errors.Is(err, errCannotConfirm) {
+			// Keep the error that made the push worth retrying.
+			pr.setStatus("FAILED")
+			return
+		}
+		r.upToDate, r.summary, r.err = upToDate, summary, err
+		if r.err == nil {
+			if r.upToDate {
+				pr.setStatus("up to date")
+			} else {
+				pr.setStatus("done")
+			}
+			return
+		}
+		if attempt >= retries || !retryable(r.err) {
+			pr.setStatus("FAILED")
+			return
+		}
+
+		wait := time.Duration(1<<attempt) * time.Second
+		pr.setStatus(fmt.Sprintf("retrying in %s (%d/%d): %v", wait, attempt+1, retries, r.err))
+		time.Sleep(wait)
+	}
+}
+
+var errCannotConfirm = errors.New("receiver can't report what it stored")
+
+// retryable reports whether a push that failed with err may succeed if
+// tried again: network errors, timeouts and server-side failures are, while
+// rejected requests and certificate mismatches are not.
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Code >= 500 || se.Code == http.StatusTooManyRequests
+	}
+	var mismatch *FingerprintMismatchError
+	return !errors.As(err, &mismatch) && !errors.Is(err, errCannotEncrypt)
+}
+
+// pushTo sends the page and its assets to addr, skipping what the receiver
+// already has unless the plan is forced. A retry asks the receiver what it
+// has even then, since the failed attempt may have been stored, and fails
+// with errCannotConfirm if the receiver predates /check.
+func (p *pushPlan) pushTo(c *client, addr string, pr *peerProgress, retry bool) (upToDate bool, summary string, err error) {
+	if p.encrypt {
+		pr.setStatus("encrypting")
+		sealed, cleanup, err := p.sealFor(c, addr)
+		if err != nil {
+			return false, "", err
+		}
+		defer cleanup()
+		p = sealed
+	}
+
+	// Ask what the receiver already has; older receivers get everything.
+	var st *checkResponse
+	if !p.force || retry {
+		pr.setStatus("checking")
+		if st, err = checkPeer(c, addr, p.filename, p.sender, p.sha256, p.assets); err != nil {
+			return false, "", err
+		}
+		if st == nil && retry {
+			return false, "", errCannotConfirm
+		}
+	}
+
+	pending := p.assets
+	var id string
+	if st != nil && st.ID != "" {
+		id = st.ID
+		pending = st.missing(p.assets)
+	}
+	pageUpToDate := st != nil && st.UpToDate
+	pr.sent.Store(0) // count only what is uploaded
+
+	if pageUpToDate && len(pending) == 0 {
+		return true, "id: " + id, nil
+	}
+
+	var total int64
+	if !pageUpToDate {
+		total += p.size
+	}
+	for _, a := range pending {
+		total += a.size
+	}
+	pr.total.Store(total)
+	pr.setStatus("sending")
+
+	if !pageUpToDate {
+		id, err = pushPage(c, p.state, addr, p.filename, p.sender, p.path, p.size, p.chunkSize, p.sealed)
+		if err != nil {
+			return false, "", err
+		}
+	}
+
+	if len(pending) > 0 {
+		if _, err := pushAssets(c, addr, p.filename, p.sender, pending, p.sealed); err != nil {
+			return false, "", fmt.Errorf("page sent (id: %s) but assets failed: %w", id, err)
+		}
+	}
+
+	return false, pushSummary(id, pageUpToDate, len(pending), len(p.assets)-len(pending)), nil
+}
+
+// sealFor returns a copy of the plan with the page and assets encrypted to
+// the receiver at addr, in temporary files that cleanup removes. The
+// receiver's encryption key must be signed by a trusted node key.
+func (p *pushPlan) sealFor(c *client, addr string) (sealed *pushPlan, cleanup func(), err error) {
+	recipient, err := receiverBoxKey(c, addr, p.trusted)
 	if err != nil {
-		return "", fmt.Errorf("POST %s: %w", url, err)
+		return nil, nil, err
 	}
-	defer resp.Body.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
+	dir, err := os.MkdirTemp("", "distrib-sealed-")
 	if err != nil {
-		return "", fmt.Errorf("read response: %w", err)
+		return nil, nil, err
 	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	s := *p
+	s.encrypt, s.sealed = false, true
+	s.path = filepath.Join(dir, "page")
+	if s.size, s.sha256, err = sealFile(s.path, p.path, c.node, recipient, p.sha256); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if s.assets, err = sealAssets(dir, c.node, recipient, p.assets); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return &s, cleanup, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("server returned %d: %s", resp.StatusCode, respBody)
+// receiverBoxKey fetches the encryption key of the receiver at addr and
+// checks that it is signed by a trusted node key.
+func receiverBoxKey(c *client, addr string, trusted *TrustedKeys) (*ecdh.PublicKey, error) {
+	var ek encryptionKey
+	err := c.doJSON(http.MethodGet, addr, "/encryption-key", nil, &ek)
+	var se *statusError
+	if errors.As(err, &se) && (se.Code == http.StatusNotFound || se.Code == http.StatusMethodNotAllowed) {
+		return nil, fmt.Errorf("%w: receiver is too old to decrypt", errCannotEncrypt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := ek.publicKey()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCannotEncrypt, err)
+	}
+	if !trusted.Has(ek.NodeKey) {
+		return nil, fmt.Errorf("%w: receiver's key is not trusted (run distrib pair first)", errCannotEncrypt)
+	}
+	return recipient, nil
+}
+
+// sealAssets encrypts each asset to recipient in a file under dir and
+// returns the sealed copies.
+func sealAssets(dir string, node ed25519.PrivateKey, recipient *ecdh.PublicKey, assets []assetData) ([]assetData, error) {
+	sealed := make([]assetData, len(assets))
+	for i, a := range assets {
+		sealed[i] = assetData{name: a.name, path: filepath.Join(dir, fmt.Sprintf("asset-%d", i))}
+		var err error
+		if sealed[i].size, sealed[i].sha256, err = sealFile(sealed[i].path, a.path, node, recipient, a.sha256); err != nil {
+			return nil, err
+		}
+	}
+	return sealed, nil
+}
+
+// printPushResults prints a table with the outcome for every peer.
+func printPushResults(results []*pushResult) {
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tADDRESS\tRESULT\tSENT\tDETAILS")
+	failed := 0
+	for _, r := range results {
+		result, details := "OK", r.summary
+		switch {
+		case r.stale:
+			result, details = "OFFLINE", "not found by discovery: "+r.err.Error()
+		case r.err != nil:
+			result, details = "FAILED", r.err.Error()
+			failed++
+		case r.upToDate:
+			result = "up to date"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.peer.Name, r.peer.Addr, result, formatBytes(r.progress.sent.Load()), details)
+	}
+	tw.Flush()
+
+	if failed > 0 {
+		fmt.Printf("\n%d of %d peer(s) failed.\n", failed, len(results))
+	}
+}
+
+// pushSummary describes what a push sent, e.g. "id: X, 2 asset(s), 1 up to
+// date".
+func pushSummary(id string, pageUpToDate bool, sent, skipped int) string {
+	parts := []string{"id: " + id}
+	if pageUpToDate {
+		parts = append(parts, "page up to date")
+	}
+	if sent > 0 {
+		parts = append(parts, fmt.Sprintf("%d asset(s)", sent))
+	}
+	if skipped > 0 {
+		parts = append(parts, fmt.Sprintf("%d up to date", skipped))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// pushPage sends the HTML file, in resumable chunks when it is larger than
+// chunkSize and the receiver supports it. encrypted tells the receiver the
+// file was sealed to its key.
+func pushPage(c *client, state *uploadState, addr, filename, sender, path string, size, chunkSize int64, encrypted bool) (string, error) {
+	if chunkSize > 0 && size > chunkSize {
+		id, err := pushFileChunked(c, state, addr, filename, sender, path, chunkSize, encrypted)
+		if !errors.Is(err, errChunkedUnsupported) {
+			return id, err
+		}
+	}
+	return pushFile(c, addr, filename, sender, path, encrypted)
+}
+
+// pushFile streams the file at path to addr without loading it into memory.
+func pushFile(c *client, addr, filename, sender, path string, encrypted bool) (string, error) {
+	build := func(writer *multipart.Writer) error {
+		if err := writer.WriteField("sender", sender); err != nil {
+			return fmt.Errorf("write sender field: %w", err)
+		}
+		if err := writeEncryptedField(writer, encrypted); err != nil {
+			return err
+		}
+
+		part, err := writer.CreateFormFile("file", filename)
+		if err != nil {
+			return fmt.Errorf("create form file: %w", err)
+		}
+		return copyFileTo(part, path)
 	}
 
 	var result struct {
 		OK bool   `json:"ok"`
 		ID string `json:"id"`
 	}
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		return "", fmt.Errorf("parse response: %w", err)
+	if err := c.postMultipart(addr, "/receive", build, &result); err != nil {
+		return "", err
 	}
 
 	return result.ID, nil
 }
+
+// writeEncryptedField declares the files in an upload encrypted, so the
+// receiver knows to decrypt them rather than serve them as they are.
+func writeEncryptedField(writer *multipart.Writer, encrypted bool) error {
+	if !encrypted {
+		return nil
+	}
+	if err := writer.WriteField("encrypted", "true"); err != nil {
+		return fmt.Errorf("write encrypted field: %w", err)
+	}
+	return nil
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	return nil
+}
@@ -1,26 +1,31 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"mime/multipart"
-	"net/http"
 	"os"
+	"path"
 	"path/filepath"
-	"time"
 )
 
 func cmdPushAssets(args []string) {
 	fs := flag.NewFlagSet("push-assets", flag.ExitOnError)
 	htmlFile := fs.String("for", "", "HTML filename this asset belongs to (required)")
-	target := fs.String("target", "", "Target address (host:port), skips discovery")
-	discoveryPort := fs.Int("discovery-port", defaultDiscoveryPort, "UDP discovery port")
-	timeout := fs.Duration("timeout", 2*time.Second, "Discovery timeout")
+	target := fs.String("target", "", "Target address (host:port or [ipv6]:port), skips discovery")
+	disc := addDiscoveryFlags(fs)
+	dataDir := fs.String("data", "", "Data directory (default: ~/.distrib)")
+	keyFlag := fs.String("key", "", "Shared key for signing requests (default: contents of <data>/secret.key)")
+	insecure := fs.Bool("insecure", false, "Use plain HTTP instead of TLS (for older receivers)")
+	force := fs.Bool("force", false, "Upload every asset even if the receiver already has it")
+	encrypt := fs.Bool("encrypt", false, "Encrypt the assets to each receiver's key, for pages pushed with -encrypt")
 	fs.Parse(args)
 
+	if err := disc.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	if *htmlFile == "" {
 		fmt.Fprintln(os.Stderr, "Error: --for flag is required (HTML filename)")
 		fmt.Fprintln(os.Stderr, "Usage: distrib push-assets --for <file.html> <asset1> [asset2] ... [flags]")
@@ -36,12 +41,31 @@ func cmdPushAssets(args []string) {
 	var assets []assetData
 	for i := 0; i < fs.NArg(); i++ {
 		path := fs.Arg(i)
-		data, err := os.ReadFile(path)
+		info, err := os.Stat(path)
+		if err == nil && !info.Mode().IsRegular() {
+			err = fmt.Errorf("not a regular file")
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: cannot read %s: %v\n", path, err)
 			os.Exit(1)
 		}
-		assets = append(assets, assetData{name: filepath.Base(path), data: data})
+		assets = append(assets, assetData{name: assetName(path), path: path})
+	}
+	if err := hashAssets(assets); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	c, err := loadClient(resolveDataDir(*dataDir), *keyFlag, *insecure)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	trusted, err := LoadTrustedKeys(resolveDataDir(*dataDir))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
 
 	hostname, _ := os.Hostname()
@@ -52,11 +76,16 @@ func cmdPushAssets(args []string) {
 	var peers []Peer
 
 	if *target != "" {
-		peers = []Peer{{Name: *target, Addr: *target}}
+		addr, err := targetAddr(*target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		peers = []Peer{{Name: *target, Addr: addr}}
 	} else {
 		fmt.Println("Discovering peers...")
 		var err error
-		peers, err = discoverPeers(*discoveryPort, *timeout)
+		peers, err = discover(disc)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: discovery failed: %v\n", err)
 			os.Exit(1)
@@ -67,78 +96,138 @@ func cmdPushAssets(args []string) {
 			os.Exit(1)
 		}
 
+		c.addPeers(peers)
 		fmt.Printf("Found %d peer(s):\n", len(peers))
+		var ok []Peer
 		for i, p := range peers {
-			fmt.Printf("  %d. %s (%s)\n", i+1, p.Name, p.Addr)
+			if !trusted.Trusted(p) {
+				fmt.Printf("  %d. %s (untrusted, skipped)\n", i+1, p.describe())
+				continue
+			}
+			fmt.Printf("  %d. %s\n", i+1, p.describe())
+			ok = append(ok, p)
+		}
+		if len(ok) == 0 {
+			fmt.Fprintln(os.Stderr, "No trusted peers; approve one with distrib push -approve <name>, or use -target.")
+			os.Exit(1)
 		}
+		peers = ok
 	}
 
 	for _, peer := range peers {
 		fmt.Printf("Pushing %d asset(s) for %s to %s... ", len(assets), *htmlFile, peer.Name)
-
-		id, err := pushAssets(peer.Addr, *htmlFile, hostname, assets)
+		summary, err := pushAssetsTo(c, peer.Addr, *htmlFile, hostname, assets, trusted, *encrypt, *force)
 		if err != nil {
 			fmt.Printf("FAILED: %v\n", err)
 			continue
 		}
-
-		fmt.Printf("OK (id: %s)\n", id)
+		fmt.Println(summary)
 	}
 }
 
-type assetData struct {
-	name string
-	data []byte
-}
-
-func pushAssets(addr, htmlFilename, sender string, assets []assetData) (string, error) {
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
-
-	if err := writer.WriteField("sender", sender); err != nil {
-		return "", fmt.Errorf("write sender field: %w", err)
+// pushAssetsTo sends assets for htmlFilename to addr, encrypted to the
+// receiver's key when encrypt is set, and skips what it already has unless
+// force is set. It refuses to send plain assets for an encrypted page.
+func pushAssetsTo(c *client, addr, htmlFilename, sender string, assets []assetData, trusted *TrustedKeys, encrypt, force bool) (string, error) {
+	if encrypt {
+		recipient, err := receiverBoxKey(c, addr, trusted)
+		if err != nil {
+			return "", err
+		}
+		dir, err := os.MkdirTemp("", "distrib-sealed-")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(dir)
+		if assets, err = sealAssets(dir, c.node, recipient, assets); err != nil {
+			return "", err
+		}
 	}
 
-	if err := writer.WriteField("for", htmlFilename); err != nil {
-		return "", fmt.Errorf("write for field: %w", err)
+	// Plain assets are checked even when forced, so they never end up next
+	// to an encrypted page.
+	var st *checkResponse
+	if !force || !encrypt {
+		var err error
+		if st, err = checkPeer(c, addr, htmlFilename, sender, "", assets); err != nil {
+			return "", err
+		}
+	}
+	if st != nil && st.Encrypted && !encrypt {
+		return "", fmt.Errorf("%s was pushed with -encrypt; push its assets with -encrypt too", htmlFilename)
 	}
 
-	for _, asset := range assets {
-		part, err := writer.CreateFormFile("files", asset.name)
-		if err != nil {
-			return "", fmt.Errorf("create form file %s: %w", asset.name, err)
-		}
-		if _, err := part.Write(asset.data); err != nil {
-			return "", fmt.Errorf("write file data %s: %w", asset.name, err)
+	pending := assets
+	if !force && st != nil && st.ID != "" {
+		pending = st.missing(assets)
+		if len(pending) == 0 {
+			return fmt.Sprintf("up to date (id: %s)", st.ID), nil
 		}
 	}
 
-	if err := writer.Close(); err != nil {
-		return "", fmt.Errorf("close multipart: %w", err)
+	id, err := pushAssets(c, addr, htmlFilename, sender, pending, encrypt)
+	if err != nil {
+		return "", err
 	}
 
-	url := fmt.Sprintf("http://%s/receive-assets", addr)
-	resp, err := http.Post(url, writer.FormDataContentType(), &body)
-	if err != nil {
-		return "", fmt.Errorf("POST %s: %w", url, err)
+	if skipped := len(assets) - len(pending); skipped > 0 {
+		return fmt.Sprintf("OK (id: %s, %d up to date)", id, skipped), nil
 	}
-	defer resp.Body.Close()
+	return fmt.Sprintf("OK (id: %s)", id), nil
+}
 
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("read response: %w", err)
+type assetData struct {
+	name   string // slash-separated path relative to the HTML file
+	path   string // location on disk
+	size   int64
+	sha256 string
+}
+
+// assetName keeps relative paths such as "img/logo.png" so the receiver can
+// recreate the directory layout; anything else is sent by its base name.
+func assetName(path string) string {
+	clean := filepath.Clean(path)
+	if filepath.IsLocal(clean) {
+		return filepath.ToSlash(clean)
 	}
+	return filepath.Base(path)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("server returned %d: %s", resp.StatusCode, respBody)
+func pushAssets(c *client, addr, htmlFilename, sender string, assets []assetData, encrypted bool) (string, error) {
+	build := func(writer *multipart.Writer) error {
+		if err := writer.WriteField("sender", sender); err != nil {
+			return fmt.Errorf("write sender field: %w", err)
+		}
+		if err := writeEncryptedField(writer, encrypted); err != nil {
+			return err
+		}
+
+		if err := writer.WriteField("for", htmlFilename); err != nil {
+			return fmt.Errorf("write for field: %w", err)
+		}
+
+		for _, asset := range assets {
+			if err := writer.WriteField("paths", asset.name); err != nil {
+				return fmt.Errorf("write path field %s: %w", asset.name, err)
+			}
+
+			part, err := writer.CreateFormFile("files", path.Base(asset.name))
+			if err != nil {
+				return fmt.Errorf("create form file %s: %w", asset.name, err)
+			}
+			if err := copyFileTo(part, asset.path); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
 	var result struct {
 		OK bool   `json:"ok"`
 		ID string `json:"id"`
 	}
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		return "", fmt.Errorf("parse response: %w", err)
+	if err := c.postMultipart(addr, "/receive-assets", build, &result); err != nil {
+		return "", err
 	}
 
 	return result.ID, nil
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	uploadStateFile = "uploads.json"
+
+	chunkRetries = 5
+)
+
+// errChunkedUnsupported means the receiver predates chunked uploads.
+var errChunkedUnsupported = errors.New("receiver does not support chunked uploads")
+
+// uploadState remembers unfinished chunked uploads per receiver and file,
+// so an interrupted push resumes where it left off.
+type uploadState struct {
+	path string
+
+	mu      sync.Mutex
+	uploads map[string]string // "addr sha256 path" -> upload ID
+}
+
+func loadUploadState(dataDir string) (*uploadState, error) {
+	s := &uploadState{
+		path:    filepath.Join(dataDir, uploadStateFile),
+		uploads: make(map[string]string),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read upload state: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.uploads); err != nil {
+		return nil, fmt.Errorf("parse upload state: %w", err)
+	}
+	return s, nil
+}
+
+func uploadKey(addr, sha, path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	return addr + " " + sha + " " + abs
+}
+
+func (s *uploadState) get(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads[key]
+}
+
+func (s *uploadState) set(key, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id == "" {
+		delete(s.uploads, key)
+	} else {
+		s.uploads[key] = id
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("create data dir: %w", err)
+	}
+	data, err := json.MarshalIndent(s.uploads, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal upload state: %w", err)
+	}
+	if err := writeFileAtomic(s.path, data, 0644); err != nil {
+		return fmt.Errorf("write upload state: %w", err)
+	}
+	return nil
+}
+
+type uploadStatus struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+}
+
+// pushFileChunked uploads a file in chunkSize pieces, resuming an earlier
+// attempt recorded in state. Chunks that fail are retried with backoff after
+// asking the receiver how much it already has.
+func pushFileChunked(c *client, state *uploadState, addr, filename, sender, path string, chunkSize int64, encrypted bool) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("hash %s: %w", path, err)
+	}
+	sha := hex.EncodeToString(h.Sum(nil))
+	key := uploadKey(addr, sha, path)
+
+	var status uploadStatus
+	if id := state.get(key); id != "" {
+		err := c.doJSON(http.MethodGet, addr, "/uploads/"+id, nil, &status)
+		var se *statusError
+		if errors.As(err, &se) && se.Code == http.StatusNotFound {
+			status = uploadStatus{}
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	if status.ID == "" {
+		req := map[string]any{"filename": filename, "sender": sender, "size": size, "sha256": sha, "encrypted": encrypted}
+		err := c.doJSON(http.MethodPost, addr, "/uploads", req, &status)
+		var se *statusError
+		if errors.As(err, &se) && (se.Code == http.StatusNotFound || se.Code == http.StatusMethodNotAllowed) {
+			return "", errChunkedUnsupported
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := state.set(key, status.ID); err != nil {
+			return "", err
+		}
+	}
+
+	// Bytes the receiver has from an earlier attempt count as delivered.
+	if c.progress != nil && status.Offset > 0 {
+		c.progress(status.Offset)
+	}
+
+	buf := make([]byte, chunkSize)
+	offset := status.Offset
+	failures := 0
+	for offset < size {
+		chunk := buf[:min(chunkSize, size-offset)]
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return "", fmt.Errorf("read %s: %w", path, err)
+		}
+
+		var res uploadStatus
+		uri := fmt.Sprintf("/uploads/%s?offset=%d", status.ID, offset)
+		err := c.do(http.MethodPut, addr, uri, "application/octet-stream", bytes.NewReader(chunk), sha256Hex(chunk), &res)
+		if err == nil {
+			offset = res.Offset
+			failures = 0
+			continue
+		}
+
+		var se *statusError
+		if errors.As(err, &se) {
+			if se.Code == http.StatusConflict {
+				// The receiver has a different amount than we thought.
+				if json.Unmarshal(se.Body, &res) == nil {
+					offset = res.Offset
+					continue
+				}
+			}
+			if se.Code < 500 {
+				return "", err
+			}
+		}
+
+		failures++
+		if failures > chunkRetries {
+			return "", fmt.Errorf("giving up after %d attempts (run the push again to resume): %w", failures, err)
+		}
+		time.Sleep(time.Duration(1<<failures) * 500 * time.Millisecond)
+
+		if err := c.doJSON(http.MethodGet, addr, "/uploads/"+status.ID, nil, &res); err == nil {
+			offset = res.Offset
+		}
+	}
+
+	var result struct {
+		OK bool   `json:"ok"`
+		ID string `json:"id"`
+	}
+	err = c.doJSON(http.MethodPost, addr, "/uploads/"+status.ID+"/finalize", nil, &result)
+	var se *statusError
+	if err == nil || (errors.As(err, &se) && se.Code == http.StatusUnprocessableEntity) {
+		if err := state.set(key, ""); err != nil {
+			return "", err
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return result.ID, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestPush returns a client for plain HTTP and a forced plan for a small
+// page, so every attempt would upload unless /check says otherwise.
+func newTestPush(t *testing.T) (*client, *pushPlan) {
+	t.Helper()
+	dir := t.TempDir()
+	c, err := loadClient(dir, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := filepath.Join(dir, "page.html")
+	if err := os.WriteFile(page, []byte("<p>hello</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := newPushPlan(page, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan.sender, plan.force = "laptop", true
+	return c, plan
+}
+
+func pushOnce(c *client, plan *pushPlan, addr string) *pushResult {
+	r := &pushResult{peer: Peer{Name: "receiver", Addr: addr}, progress: &peerProgress{name: "receiver"}}
+	pushWithRetries(c, plan, r, 2)
+	return r
+}
+
+func TestPushRetryChecksBeforeResending(t *testing.T) {
+	store := newTestStore(t, 4)
+	dir := t.TempDir()
+	paired, err := LoadPairedSenders(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := LoadACL(dir, paired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := handleReceive(store, NewSSEBroker(), acl, 1<<20)
+
+	// The first upload is stored, but its reply is lost to a server error.
+	var receives atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /check", handleCheck(store))
+	mux.HandleFunc("POST /receive", func(w http.ResponseWriter, r *http.Request) {
+		if receives.Add(1) == 1 {
+			receive(httptest.NewRecorder(), r)
+			jsonError(w, "lost reply", http.StatusBadGateway)
+			return
+		}
+		receive(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c, plan := newTestPush(t)
+	r := pushOnce(c, plan, strings.TrimPrefix(srv.URL, "http://"))
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !r.upToDate {
+		t.Error("retry sent the page again instead of finding it stored")
+	}
+	if n := receives.Load(); n != 1 {
+		t.Errorf("POST /receive sent %d times, want 1", n)
+	}
+	if e := store.FindByFilenameAndSender("page.html", "laptop", ""); e == nil || e.Revision != 1 {
+		t.Errorf("stored entry %+v, want revision 1", e)
+	}
+}
+
+func TestPushNoRetryWithoutCheck(t *testing.T) {
+	var receives atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /receive", func(w http.ResponseWriter, r *http.Request) {
+		receives.Add(1)
+		jsonError(w, "lost reply", http.StatusBadGateway)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c, plan := newTestPush(t)
+	r := pushOnce(c, plan, strings.TrimPrefix(srv.URL, "http://"))
+	if r.err == nil || !strings.Contains(r.err.Error(), "lost reply") {
+		t.Errorf("got %v, want the server's error", r.err)
+	}
+	if n := receives.Load(); n != 1 {
+		t.Errorf("POST /receive sent %d times to a receiver without /check, want 1", n)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// recover cleans up after a crash or power loss. Writes are ordered so that
+// meta.json is the commit point of an entry: contents are stored first, and
+// anything that was being written when the process stopped is removed here.
+// Contents that were stored but never referenced are left to GC.
+func (s *Store) recover() {
+	// Uploads that never made it into the store.
+	if entries, err := os.ReadDir(s.tmpDir); err == nil {
+		for _, e := range entries {
+			os.RemoveAll(filepath.Join(s.tmpDir, e.Name()))
+		}
+	}
+
+	entries, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !validID.MatchString(e.Name()) {
+			continue
+		}
+		s.recoverEntry(e.Name())
+	}
+}
+
+func (s *Store) recoverEntry(id string) {
+	entryDir := filepath.Join(s.baseDir, id)
+
+	// writeFileAtomic only writes meta.json and versions/<n>/version.json,
+	// so those are the only places to look; anything else is content.
+	dirs := []string{entryDir}
+	if versions, err := filepath.Glob(filepath.Join(entryDir, "versions", "*")); err == nil {
+		dirs = append(dirs, versions...)
+	}
+	for _, dir := range dirs {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if !f.IsDir() && isAtomicTemp(f.Name()) {
+				path := filepath.Join(dir, f.Name())
+				log.Printf("Recovery: removing partial write %s", path)
+				os.Remove(path)
+			}
+		}
+	}
+
+	if _, err := s.readMeta(id); err != nil {
+		// The entry was never committed.
+		log.Printf("Recovery: removing incomplete entry %s: %v", id, err)
+		os.RemoveAll(entryDir)
+	}
+}
+
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxScanHosts bounds a sweep to a /16 worth of IPv4 addresses.
+	maxScanHosts = 1 << 16
+
+	// scanConcurrency is how many /health probes run at once, enough to
+	// try a whole /24 in one go.
+	scanConcurrency = 256
+)
+
+// parseScanPrefixes parses a comma-separated list of CIDRs for -scan.
+func parseScanPrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -scan range %q: %w", s, err)
+		}
+		if hostBits := p.Addr().BitLen() - p.Bits(); hostBits > 16 {
+			return nil, fmt.Errorf("-scan range %s is too large (at most %d addresses)", s, maxScanHosts)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// scanHosts lists the addresses in prefixes, leaving out the network and
+// broadcast addresses of IPv4 subnets that have them.
+func scanHosts(prefixes []netip.Prefix) []netip.Addr {
+	var hosts []netip.Addr
+	for _, p := range prefixes {
+		first := p.Addr()
+		skipEnds := first.Is4() && p.Bits() <= 30
+		for a := first; a.IsValid() && p.Contains(a); a = a.Next() {
+			if skipEnds && (a == first || !p.Contains(a.Next())) {
+				continue
+			}
+			hosts = append(hosts, a)
+		}
+	}
+	return hosts
+}
+
+// scanSubnets sweeps the given ranges for receivers, for networks where
+// broadcasts don't get through. Every address gets a unicast discovery
+// request, and /health is probed on httpPort at the same time, which also
+// finds receivers whose discovery port is filtered. Addresses not probed
+// within timeout are skipped.
+func scanSubnets(prefixes []netip.Prefix, discoveryPort, httpPort int, timeout time.Duration, nonce string) []Peer {
+	hosts := scanHosts(prefixes)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	var udpPeers, httpPeers []Peer
+	var wg sync.WaitGroup
+	wg.Go(func() { udpPeers = scanUDP(hosts, discoveryPort, deadline, nonce) })
+	wg.Go(func() { httpPeers = scanHTTP(ctx, hosts, httpPort) })
+	wg.Wait()
+
+	return mergePeers(udpPeers, httpPeers)
+}
+
+func scanUDP(hosts []netip.Addr, discoveryPort int, deadline time.Time, nonce string) []Peer {
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		log.Printf("scan: open UDP socket: %v", err)
+		return nil
+	}
+	defer conn.Close()
+
+	msgs := discoveryRequests(nonce)
+	go func() {
+		for _, h := range hosts {
+			addr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(h, uint16(discoveryPort)))
+			sendAll(conn, msgs, addr) // unreachable hosts are expected
+		}
+	}()
+	return readReplies(conn, deadline, nonce)
+}
+
+func scanHTTP(ctx context.Context, hosts []netip.Addr, httpPort int) []Peer {
+	hc := &http.Client{
+		Transport: &http.Transport{
+			// Only looking: the certificate is pinned on the first real
+			// request, against the fingerprint recorded here.
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+
+	work := make(chan netip.Addr)
+	var mu sync.Mutex
+	var peers []Peer
+	var wg sync.WaitGroup
+	for range min(scanConcurrency, len(hosts)) {
+		wg.Go(func() {
+			for h := range work {
+				addr := netip.AddrPortFrom(h, uint16(httpPort)).String()
+				if p, ok := probeHealth(ctx, hc, addr); ok {
+					mu.Lock()
+					peers = append(peers, p)
+					mu.Unlock()
+				}
+			}
+		})
+	}
+feed:
+	for _, h := range hosts {
+		select {
+		case work <- h:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	return peers
+}
+
+// probeHealth checks whether a receiver answers /health at addr.
+func probeHealth(ctx context.Context, hc *http.Client, addr string) (Peer, bool) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+addr+"/health", nil)
+	if err != nil {
+		return Peer{}, false
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return Peer{}, false
+	}
+	defer resp.Body.Close()
+
+	var h healthResponse
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&h) != nil || h.Status != "ok" {
+		return Peer{}, false
+	}
+
+	p := Peer{Name: h.Name, Addr: addr, Version: h.Version, Tags: h.Tags}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		p.Fingerprint = certFingerprint(resp.TLS.PeerCertificates[0].Raw)
+	}
+	return p, true
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Files pushed with -encrypt are sealed to the receiver's X25519 key and
+// stored that way. A sealed file is a header (magic, version and the
+// sender's ephemeral public key) followed by the content in segments of
+// sealSegmentSize bytes, each encrypted with AES-256-GCM. The key comes from
+// HKDF over the X25519 shared secret. Segment nonces count up and mark the
+// last segment, so segments can't be reordered or dropped, and fixed-size
+// segments let the receiver decrypt any range without reading from the
+// start.
+const (
+	boxKeyFile = "box.key"
+
+	sealMagic       = "DSTRBE2E"
+	sealVersion     = 1
+	sealHeaderSize  = len(sealMagic) + 1 + 32
+	sealSegmentSize = 64 << 10
+	sealOverhead    = 16 // GCM tag per segment
+)
+
+var errCannotEncrypt = errors.New("cannot encrypt")
+
+// loadOrCreateBoxKey loads the receiver's X25519 key, which files are
+// encrypted to, generating it on first start.
+func loadOrCreateBoxKey(dataDir string) (*ecdh.PrivateKey, error) {
+	key, err := loadOrCreatePrivateKey(filepath.Join(dataDir, boxKeyFile), func() (any, error) {
+		return ecdh.X25519().GenerateKey(rand.Reader)
+	})
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(*ecdh.PrivateKey)
+	if !ok || priv.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("parse %s: not an X25519 key", boxKeyFile)
+	}
+	return priv, nil
+}
+
+// encryptionKey is what GET /encryption-key returns: the receiver's X25519
+// key, signed by its node key so senders can check it against trusted_keys.
+type encryptionKey struct {
+	Key     string `json:"key"`
+	NodeKey string `json:"node_key"`
+	Sig     string `json:"sig"`
+}
+
+func newEncryptionKey(node ed25519.PrivateKey, box *ecdh.PrivateKey) encryptionKey {
+	k := encryptionKey{
+		Key:     hex.EncodeToString(box.PublicKey().Bytes()),
+		NodeKey: publicKeyHex(node),
+	}
+	k.Sig = hex.EncodeToString(ed25519.Sign(node, k.signedBytes()))
+	return k
+}
+
+func (k encryptionKey) signedBytes() []byte {
+	return []byte("distrib-encryption-key-v1\n" + k.Key)
+}
+
+// publicKey checks the signature and returns the X25519 key.
+func (k encryptionKey) publicKey() (*ecdh.PublicKey, error) {
+	node, err := hex.DecodeString(k.NodeKey)
+	if err != nil || len(node) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid node key")
+	}
+	sig, err := hex.DecodeString(k.Sig)
+	if err != nil || !ed25519.Verify(node, k.signedBytes(), sig) {
+		return nil, errors.New("invalid signature on encryption key")
+	}
+	raw, err := hex.DecodeString(k.Key)
+	if err != nil {
+		return nil, errors.New("invalid encryption key")
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+func sealAEAD(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	salt := append(ephemeral[:len(ephemeral):len(ephemeral)], recipient...)
+	key, err := hkdf.Key(sha256.New, shared, salt, "distrib-e2e-v1", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealNonce(i uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], i)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// sealEphemeralKey derives the ephemeral key for sealing content with the
+// given SHA256 to recipient. It is deterministic, so pushing the same file
+// again produces the same bytes and the receiver can tell it is up to date,
+// as it can for files that aren't encrypted.
+func sealEphemeralKey(node ed25519.PrivateKey, recipient *ecdh.PublicKey, sha string) (*ecdh.PrivateKey, error) {
+	seed, err := hkdf.Key(sha256.New, node.Seed(), recipient.Bytes(), "distrib-e2e-ephemeral\n"+sha, 32)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(seed)
+}
+
+// seal encrypts src to recipient and writes the sealed file to dst.
+func seal(dst io.Writer, src io.Reader, ephemeral *ecdh.PrivateKey, recipient *ecdh.PublicKey) error {
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return err
+	}
+	aead, err := sealAEAD(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return err
+	}
+
+	header := append([]byte(sealMagic), sealVersion)
+	header = append(header, ephemeral.PublicKey().Bytes()...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	// Read one segment ahead to know which one is last.
+	buf := make([]byte, sealSegmentSize)
+	next := make([]byte, sealSegmentSize)
+	n, err := io.ReadFull(src, buf)
+	out := make([]byte, 0, sealSegmentSize+sealOverhead)
+	for i := uint64(0); ; i++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		var m int
+		if !last {
+			m, err = io.ReadFull(src, next)
+			if m == 0 && err == io.EOF {
+				last = true
+			}
+		}
+
+		out = aead.Seal(out[:0], sealNonce(i, last), buf[:n], header)
+		if _, werr := dst.Write(out); werr != nil {
+			return werr
+		}
+		if last {
+			return nil
+		}
+		buf, next, n = next, buf, m
+	}
+}
+
+// sealFile encrypts the file at src to recipient into dst and returns the
+// sealed size and SHA256.
+func sealFile(dst, src string, node ed25519.PrivateKey, recipient *ecdh.PublicKey, sha string) (int64, string, error) {
+	ephemeral, err := sealEphemeralKey(node, recipient, sha)
+	if err != nil {
+		return 0, "", err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, "", err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, "", err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(out, h)}
+	if err := seal(cw, in, ephemeral, recipient); err != nil {
+		return 0, "", fmt.Errorf("encrypt %s: %w", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return 0, "", err
+	}
+	return cw.n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// isSealed reports whether r starts with the header of a sealed file.
+func isSealed(r io.ReaderAt) bool {
+	var magic [len(sealMagic) + 1]byte
+	_, err := r.ReadAt(magic[:], 0)
+	return err == nil && bytes.Equal(magic[:], append([]byte(sealMagic), sealVersion))
+}
+
+// sealedReader decrypts a sealed file on demand. It implements io.ReadSeeker
+// over the plaintext, so http.ServeContent can answer range requests.
+type sealedReader struct {
+	f      io.ReaderAt
+	aead   cipher.AEAD
+	header []byte
+
+	segments int64
+	size     int64 // plaintext
+	off      int64
+
+	seg    []byte // the decrypted segment at segIdx
+	segIdx int64
+	ct     []byte
+}
+
+// openSealed prepares to decrypt the sealed file f with the receiver's key.
+func openSealed(f *os.File, box *ecdh.PrivateKey) (*sealedReader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, sealHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil || !isSealed(f) {
+		return nil, errors.New("not an encrypted file")
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(header[len(sealMagic)+1:])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := box.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealAEAD(shared, ephemeral.Bytes(), box.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	body := info.Size() - int64(sealHeaderSize)
+	if body < sealOverhead {
+		return nil, errors.New("truncated encrypted file")
+	}
+	segments := (body + sealSegmentSize + sealOverhead - 1) / (sealSegmentSize + sealOverhead)
+	return &sealedReader{
+		f:        f,
+		aead:     aead,
+		header:   header,
+		segments: segments,
+		size:     body - segments*sealOverhead,
+		segIdx:   -1,
+	}, nil
+}
+
+func (s *sealedReader) Read(p []byte) (int, error) {
+	if s.off >= s.size {
+		return 0, io.EOF
+	}
+	idx := s.off / sealSegmentSize
+	if idx != s.segIdx {
+		if err := s.load(idx); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.seg[s.off-idx*sealSegmentSize:])
+	s.off += int64(n)
+	return n, nil
+}
+
+func (s *sealedReader) load(idx int64) error {
+	start := int64(sealHeaderSize) + idx*(sealSegmentSize+sealOverhead)
+	length := min(int64(sealSegmentSize+sealOverhead), int64(sealHeaderSize)+s.size+s.segments*sealOverhead-start)
+	if int64(cap(s.ct)) < length {
+		s.ct = make([]byte, length)
+	}
+	s.ct = s.ct[:length]
+	if _, err := s.f.ReadAt(s.ct, start); err != nil {
+		return err
+	}
+	seg, err := s.aead.Open(s.seg[:0], sealNonce(uint64(idx), idx == s.segments-1), s.ct, s.header)
+	if err != nil {
+		s.segIdx = -1
+		return errors.New("decrypt: file is corrupt or was encrypted for another receiver")
+	}
+	s.seg, s.segIdx = seg, idx
+	return nil
+}
+
+func (s *sealedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.off
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.off = offset
+	return offset, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// namePattern matches peer names case-insensitively. Patterns are shell
+// globs ("living-*"), or regular expressions when wrapped in slashes
+// ("/^(tv|office)/").
+type namePattern struct {
+	raw  string
+	glob string
+	re   *regexp.Regexp
+}
+
+// parsePatterns parses a comma-separated list of name patterns.
+func parsePatterns(list string) ([]namePattern, error) {
+	var patterns []namePattern
+	for _, raw := range strings.Split(list, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		p := namePattern{raw: raw}
+		if len(raw) > 1 && strings.HasPrefix(raw, "/") && strings.HasSuffix(raw, "/") {
+			re, err := regexp.Compile("(?i)" + raw[1:len(raw)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", raw, err)
+			}
+			p.re = re
+		} else {
+			p.glob = strings.ToLower(raw)
+			if _, err := path.Match(p.glob, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", raw, err)
+			}
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func (p namePattern) match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	ok, _ := path.Match(p.glob, strings.ToLower(name))
+	return ok
+}
+
+// filterPeers keeps the peers whose name matches one of include (or all of
+// them when include is empty) and none of exclude. It also returns the
+// include patterns that matched no peer at all.
+func filterPeers(peers []Peer, include, exclude []namePattern) (selected []Peer, unmatched []string) {
+	used := make([]bool, len(include))
+	for _, peer := range peers {
+		ok := len(include) == 0
+		for i, p := range include {
+			if p.match(peer.Name) {
+				ok, used[i] = true, true
+			}
+		}
+		for _, p := range exclude {
+			if p.match(peer.Name) {
+				ok = false
+			}
+		}
+		if ok {
+			selected = append(selected, peer)
+		}
+	}
+	for i, p := range include {
+		if !used[i] {
+			unmatched = append(unmatched, p.raw)
+		}
+	}
+	return selected, unmatched
+}
+
+// filterGroups keeps the peers advertising at least one of tags, or all of
+// them when tags is empty. Receivers too old to advertise tags never match.
+func filterGroups(peers []Peer, tags []string) []Peer {
+	if len(tags) == 0 {
+		return peers
+	}
+	var selected []Peer
+	for _, peer := range peers {
+		if slices.ContainsFunc(tags, peer.hasTag) {
+			selected = append(selected, peer)
+		}
+	}
+	return selected
+}
+
+// pickPeers lists peers, each described by describe, and asks which to
+// push to.
+func pickPeers(in io.Reader, out io.Writer, peers []Peer, describe func(Peer) string) ([]Peer, error) {
+	fmt.Fprintln(out, "Choose peers:")
+	for i, p := range peers {
+		fmt.Fprintf(out, "  %d. %s\n", i+1, describe(p))
+	}
+
+	r := bufio.NewReader(in)
+	for {
+		fmt.Fprint(out, "Push to [all, or numbers like 1,3 or 2-4]: ")
+		line, err := r.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("no selection: %w", err)
+		}
+
+		indexes, perr := parseSelection(line, len(peers))
+		if perr != nil {
+			fmt.Fprintf(out, "  %v\n", perr)
+			if err != nil {
+				return nil, perr
+			}
+			continue
+		}
+
+		var picked []Peer
+		for _, i := range indexes {
+			picked = append(picked, peers[i])
+		}
+		return picked, nil
+	}
+}
+
+// parseSelection parses a picker answer such as "all", "2" or "1,3-4" into
+// zero-based indexes below n.
+func parseSelection(s string, n int) ([]int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.EqualFold(s, "all") || s == "*" {
+		indexes := make([]int, n)
+		for i := range indexes {
+			indexes[i] = i
+		}
+		return indexes, nil
+	}
+
+	seen := make(map[int]bool)
+	var indexes []int
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		lo, hi, isRange := strings.Cut(field, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(lo))
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(strings.TrimSpace(hi))
+		}
+		if err != nil || from < 1 || to > n || from > to {
+			return nil, fmt.Errorf("invalid choice %q (pick between 1 and %d)", field, n)
+		}
+		for i := from; i <= to; i++ {
+			if !seen[i] {
+				seen[i] = true
+				indexes = append(indexes, i-1)
+			}
+		}
+	}
+	return indexes, nil
+}
@@ -2,17 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -21,14 +29,30 @@ import (
 //go:embed web/index.html
 var webFS embed.FS
 
+// serverCapabilities lists optional features, advertised during discovery so
+// clients can tell what a receiver supports without probing it.
+var serverCapabilities = []string{"tls", "assets", "chunked", "versions", "check", "pair", "e2e"}
+
 func cmdServe(args []string) {
 	fs := flag.NewFlagSet("serve", flag.ExitOnError)
 	port := fs.Int("port", defaultHTTPPort, "HTTP port")
 	discoveryPort := fs.Int("discovery-port", defaultDiscoveryPort, "UDP discovery port")
+	discovery := fs.String("discovery", "both", "How to be found: broadcast, mdns or both")
+	mdnsAddr := fs.String("mdns-addr", defaultMDNSAddr, "Multicast group and port for mDNS")
 	name := fs.String("name", "", "Machine name (default: hostname)")
 	dataDir := fs.String("data", "", "Data directory (default: ~/.distrib)")
+	keepVersions := fs.Int("keep-versions", 10, "Previous revisions to keep per file (0 disables history)")
+	maxSizeMB := fs.Int64("max-size", 512, "Maximum upload size in MB")
+	keyFlag := fs.String("key", "", "Shared key required to push or delete (default: contents of <data>/secret.key)")
+	tagsFlag := fs.String("tags", "", "Comma-separated tags to advertise, for push -group (e.g. kids,tv)")
+	strict := fs.Bool("strict", false, "Only accept uploads from senders paired with distrib pair")
+	requireTLS := fs.Bool("require-tls", false, "Refuse uploads from other machines over plain HTTP")
 	fs.Parse(args)
 
+	tags := parseTags(*tagsFlag)
+	if !validDiscoveryMethod(*discovery) {
+		log.Fatalf("Unknown -discovery %q (want broadcast, mdns or both)", *discovery)
+	}
 	if *name == "" {
 		hostname, err := os.Hostname()
 		if err != nil {
@@ -37,41 +61,108 @@ func cmdServe(args []string) {
 		*name = hostname
 	}
 
-	if *dataDir == "" {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			log.Fatalf("Cannot determine home directory: %v", err)
-		}
-		*dataDir = filepath.Join(home, ".distrib")
+	*dataDir = resolveDataDir(*dataDir)
+
+	key, err := loadKey(*keyFlag, *dataDir)
+	if err != nil {
+		log.Fatalf("Load key: %v", err)
 	}
+	auth := NewAuthenticator(key)
 
-	store, err := NewStore(*dataDir)
+	paired, err := LoadPairedSenders(*dataDir)
+	if err != nil {
+		log.Fatalf("Load paired senders: %v", err)
+	}
+	store, err := NewStore(*dataDir, *keepVersions, paired)
 	if err != nil {
 		log.Fatalf("Initialize storage: %v", err)
 	}
 
+	cert, err := loadOrCreateCert(*dataDir, *name)
+	if err != nil {
+		log.Fatalf("Initialize TLS: %v", err)
+	}
+	fingerprint := certFingerprint(cert.Certificate[0])
+
+	nodeKey, err := loadOrCreateNodeKey(*dataDir)
+	if err != nil {
+		log.Fatalf("Initialize node key: %v", err)
+	}
+	boxKey, err := loadOrCreateBoxKey(*dataDir)
+	if err != nil {
+		log.Fatalf("Initialize encryption key: %v", err)
+	}
+	senders := NewSenderAuth(paired, nodeKey, *strict)
+	acl, err := LoadACL(*dataDir, paired)
+	if err != nil {
+		log.Fatalf("Load access control: %v", err)
+	}
+
+	uploads, err := NewChunkedUploads(*dataDir)
+	if err != nil {
+		log.Fatalf("Initialize uploads: %v", err)
+	}
+
 	broker := NewSSEBroker()
+	pairings := NewPairings(*name, nodeKey, paired, broker)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	go func() {
-		if err := listenForDiscovery(ctx, *discoveryPort, *name, *port); err != nil {
-			log.Printf("Discovery listener error: %v", err)
-		}
-	}()
+	a := announcement{
+		Name:         *name,
+		Port:         *port,
+		Fingerprint:  fingerprint,
+		Version:      version,
+		Tags:         tags,
+		Capabilities: serverCapabilities,
+		Key:          publicKeyHex(nodeKey),
+	}
+	go acl.watch(ctx)
+	if *discovery != "mdns" {
+		go func() {
+			if err := listenForDiscovery(ctx, *discoveryPort, a, nodeKey); err != nil {
+				log.Printf("Discovery listener error: %v", err)
+			}
+		}()
+	}
+	if *discovery != "broadcast" {
+		go func() {
+			if err := advertiseMDNS(ctx, *mdnsAddr, a); err != nil {
+				log.Printf("mDNS error: %v", err)
+			}
+		}()
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /receive", handleReceive(store, broker))
-	mux.HandleFunc("POST /receive-assets", handleReceiveAssets(store, broker))
+	maxSize := *maxSizeMB << 20
+	upload := func(next http.HandlerFunc) http.HandlerFunc {
+		return checkTransport(*requireTLS, auth.Require(senders.Identify(next, false), false))
+	}
+	mux.HandleFunc("POST /receive", upload(handleReceive(store, broker, acl, maxSize)))
+	mux.HandleFunc("POST /receive-assets", upload(handleReceiveAssets(store, broker, acl, maxSize)))
+	mux.HandleFunc("POST /check", senders.Identify(handleCheck(store), false))
+	mux.HandleFunc("POST /uploads", upload(handleUploadCreate(uploads, acl, maxSize)))
+	mux.HandleFunc("GET /uploads/{uid}", auth.Require(handleUploadStatus(uploads), false))
+	mux.HandleFunc("PUT /uploads/{uid}", upload(handleUploadChunk(uploads)))
+	mux.HandleFunc("POST /uploads/{uid}/finalize", upload(handleUploadFinalize(uploads, store, broker, acl)))
+	mux.HandleFunc("POST /pair", auth.Require(handlePairStart(pairings), false))
+	mux.HandleFunc("POST /pair/{id}/commit", auth.Require(handlePairCommit(pairings), false))
+	mux.HandleFunc("POST /pair/{id}/reveal", auth.Require(handlePairReveal(pairings), false))
+	mux.HandleFunc("DELETE /pair/{id}", handlePairReject(pairings))
+	mux.HandleFunc("GET /pair", handlePairList(pairings))
+	mux.HandleFunc("GET /encryption-key", handleEncryptionKey(newEncryptionKey(nodeKey, boxKey)))
 	mux.HandleFunc("GET /files", handleFiles(store))
-	mux.HandleFunc("DELETE /files/{id}", handleFileDelete(store, broker))
+	mux.HandleFunc("DELETE /files/{id}", auth.Require(senders.Identify(handleFileDelete(store, broker, acl), true), true))
 	mux.HandleFunc("GET /files/{id}", handleFileView(store))
 	mux.HandleFunc("GET /files/{id}/raw", handleFileRawRedirect())
-	mux.HandleFunc("GET /files/{id}/raw/", handleFileRaw(store))
-	mux.HandleFunc("GET /files/{id}/raw/{path...}", handleFileAsset(store))
+	mux.HandleFunc("GET /files/{id}/raw/{path...}", handleFileRaw(store, boxKey))
+	mux.HandleFunc("GET /files/{id}/versions", handleVersions(store))
+	mux.HandleFunc("GET /files/{id}/versions/{rev}/raw", handleFileRawRedirect())
+	mux.HandleFunc("GET /files/{id}/versions/{rev}/raw/{path...}", handleVersionRaw(store, boxKey))
+	mux.HandleFunc("POST /files/{id}/versions/{rev}/restore", auth.Require(senders.Identify(handleVersionRestore(store, broker, acl), true), true))
 	mux.HandleFunc("GET /events", broker.ServeHTTP)
-	mux.HandleFunc("GET /health", handleHealth(*name))
+	mux.HandleFunc("GET /health", handleHealth(*name, tags, store))
 	mux.HandleFunc("GET /", handleIndex())
 
 	server := &http.Server{
@@ -86,60 +177,189 @@ func cmdServe(args []string) {
 		server.Shutdown(shutdownCtx)
 	}()
 
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatalf("HTTP server: %v", err)
+	}
+	ln = newSniffListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+
 	log.Printf("Distrib serving on :%d as %q", *port, *name)
 	log.Printf("Web UI: http://localhost:%d/files", *port)
+	log.Printf("TLS fingerprint: %s", fingerprint)
+	log.Printf("Node key: %s", a.Key)
+	if len(tags) > 0 {
+		log.Printf("Tags: %s", strings.Join(tags, ", "))
+	}
+	if auth != nil {
+		log.Printf("Shared-key authentication enabled")
+	}
+	if *strict {
+		log.Printf("Strict mode: only accepting uploads from paired senders")
+	}
+	if *requireTLS {
+		log.Printf("Refusing uploads over plain HTTP from other machines")
+	}
+	acl.logPolicy()
 
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+	if err := server.Serve(ln); err != http.ErrServerClosed {
 		log.Fatalf("HTTP server: %v", err)
 	}
 }
 
-func handleReceive(store *Store, broker *SSEBroker) http.HandlerFunc {
+func handleReceive(store *Store, broker *SSEBroker, acl *ACL, maxSize int64) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseMultipartForm(50 << 20); err != nil {
-			jsonError(w, "parse form: "+err.Error(), http.StatusBadRequest)
+		policy := acl.policy(r)
+		if err := policy.push(); err != nil {
+			aclError(w, err)
 			return
 		}
 
-		file, header, err := r.FormFile("file")
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		mr, err := r.MultipartReader()
 		if err != nil {
-			jsonError(w, "missing file field", http.StatusBadRequest)
+			jsonError(w, "parse form: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer file.Close()
 
-		sender := r.FormValue("sender")
-		if sender == "" {
-			sender = "unknown"
+		// Fields may arrive in any order, so the file is streamed to a
+		// temporary upload and only moved into the store at the end.
+		var upload *Upload
+		var filename, sender string
+		var encrypted bool
+		defer func() {
+			if upload != nil {
+				upload.Discard()
+			}
+		}()
+
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				uploadError(w, "parse form", err)
+				return
+			}
+
+			switch part.FormName() {
+			case "file":
+				if upload != nil {
+					jsonError(w, "more than one file field", http.StatusBadRequest)
+					return
+				}
+				upload, err = store.NewUpload()
+				if err != nil {
+					jsonError(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				filename = part.FileName()
+				if err := policy.file(filename, -1); err != nil {
+					aclError(w, err)
+					return
+				}
+				if _, err := io.Copy(upload, policy.limitReader(part)); err != nil {
+					uploadError(w, "read file", err)
+					return
+				}
+				if err := policy.file(filename, upload.Size()); err != nil {
+					aclError(w, err)
+					return
+				}
+			case "sender":
+				if sender, err = readFormField(part); err != nil {
+					uploadError(w, "read sender", err)
+					return
+				}
+			case "encrypted":
+				value, err := readFormField(part)
+				if err != nil {
+					uploadError(w, "read encrypted", err)
+					return
+				}
+				encrypted = value == "true"
+			}
 		}
 
-		data, err := io.ReadAll(file)
-		if err != nil {
-			jsonError(w, "read file: "+err.Error(), http.StatusInternalServerError)
+		if err := finishBody(r); err != nil {
+			uploadError(w, "read body", err)
 			return
 		}
 
-		entry, updated, err := store.Save(header.Filename, sender, data)
+		if upload == nil || filename == "" {
+			jsonError(w, "missing file field", http.StatusBadRequest)
+			return
+		}
+		if sender == "" {
+			sender = "unknown"
+		}
+
+		entry, updated, err := store.Save(filename, sender, senderKey(r), encrypted, upload)
 		if err != nil {
 			jsonError(w, "save file: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if updated {
-			log.Printf("Updated %q from %s (%d bytes)", entry.Filename, entry.Sender, entry.Size)
-			go sendNotification("Distrib", fmt.Sprintf("Updated %s from %s", entry.Filename, entry.Sender))
-			broker.PublishUpdate(entry)
-		} else {
-			log.Printf("Received %q from %s (%d bytes)", entry.Filename, entry.Sender, entry.Size)
-			go sendNotification("Distrib", fmt.Sprintf("Received %s from %s", entry.Filename, entry.Sender))
-			broker.Publish(entry)
-		}
+		announceEntry(broker, entry, updated)
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]any{"ok": true, "id": entry.ID})
 	}
 }
 
+// checkTransport handles uploads that reach the receiver over plain HTTP
+// from another machine, as older clients and -insecure send them. Anyone on
+// the path can read those, and change them unless they are signed. With
+// requireTLS they are refused; otherwise unsigned ones are logged.
+func checkTransport(requireTLS bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil && !isLoopback(r.RemoteAddr) {
+			if requireTLS {
+				jsonError(w, "forbidden: uploads must use TLS", http.StatusForbidden)
+				return
+			}
+			if r.Header.Get(headerSignature) == "" && r.Header.Get(headerSenderSignature) == "" {
+				log.Printf("Warning: unsigned upload over plain HTTP from %s (%s %s); start with -require-tls to refuse these", r.RemoteAddr, r.Method, r.URL.Path)
+			}
+		}
+		next(w, r)
+	}
+}
+
+// announceEntry logs a received file, shows a notification and tells
+// connected web UIs about it.
+func announceEntry(broker *SSEBroker, entry *FileEntry, updated bool) {
+	if updated {
+		log.Printf("Updated %q from %s (%d bytes)", entry.Filename, entry.Sender, entry.Size)
+		go sendNotification("Distrib", fmt.Sprintf("Updated %s from %s", entry.Filename, entry.Sender))
+		broker.PublishUpdate(entry)
+	} else {
+		log.Printf("Received %q from %s (%d bytes)", entry.Filename, entry.Sender, entry.Size)
+		go sendNotification("Distrib", fmt.Sprintf("Received %s from %s", entry.Filename, entry.Sender))
+		broker.Publish(entry)
+	}
+}
+
+// readFormField reads a small, non-file multipart field.
+func readFormField(part *multipart.Part) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(part, 4096))
+	return string(data), err
+}
+
+// uploadError reports a failure while reading a request body, mapping an
+// oversized body to 413 and a body that fails signature checks to 401.
+func uploadError(w http.ResponseWriter, msg string, err error) {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		jsonError(w, fmt.Sprintf("upload exceeds maximum size of %d bytes", maxErr.Limit), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errBodyMismatch):
+		jsonError(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+	default:
+		jsonError(w, msg+": "+err.Error(), http.StatusBadRequest)
+	}
+}
+
 func handleFiles(store *Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		accept := r.Header.Get("Accept")
@@ -148,24 +368,67 @@ func handleFiles(store *Store) http.HandlerFunc {
 			return
 		}
 
-		files, err := store.List()
+		opts, err := parseListOptions(r.URL.Query())
 		if err != nil {
-			jsonError(w, "list files: "+err.Error(), http.StatusInternalServerError)
+			jsonError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		if files == nil {
-			files = []FileEntry{}
-		}
+		files, total := store.List(opts)
 
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
 		json.NewEncoder(w).Encode(files)
 	}
 }
 
-func handleFileDelete(store *Store, broker *SSEBroker) http.HandlerFunc {
+// parseListOptions reads sort, order, offset and limit from a /files query.
+// By default entries are listed newest first.
+func parseListOptions(q url.Values) (ListOptions, error) {
+	opts := ListOptions{Sort: "received_at", Desc: true}
+
+	if v := q.Get("sort"); v != "" {
+		if _, ok := listSorts[v]; !ok {
+			return opts, fmt.Errorf("invalid sort %q", v)
+		}
+		opts.Sort = v
+		opts.Desc = v == "received_at" || v == "size"
+	}
+	switch q.Get("order") {
+	case "":
+	case "asc":
+		opts.Desc = false
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, fmt.Errorf("invalid order %q", q.Get("order"))
+	}
+
+	for name, dst := range map[string]*int{"offset": &opts.Offset, "limit": &opts.Limit} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid %s %q", name, v)
+		}
+		*dst = n
+	}
+	return opts, nil
+}
+
+func handleFileDelete(store *Store, broker *SSEBroker, acl *ACL) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
+		entry, err := store.Get(id)
+		if err != nil {
+			jsonError(w, "file not found", http.StatusNotFound)
+			return
+		}
+		if err := acl.policy(r).delete(r, entry); err != nil {
+			aclError(w, err)
+			return
+		}
 		if err := store.Delete(id); err != nil {
 			jsonError(w, "delete file: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -197,89 +460,288 @@ func handleFileRawRedirect() http.HandlerFunc {
 	}
 }
 
-func handleFileRaw(store *Store) http.HandlerFunc {
+func handleFileRaw(store *Store, box *ecdh.PrivateKey) http.HandlerFunc {
+	serveAsset := handleFileAsset(store, box)
 	return func(w http.ResponseWriter, r *http.Request) {
-		id := r.PathValue("id")
-		path, err := store.FilePath(id)
+		if r.PathValue("path") != "" {
+			serveAsset(w, r)
+			return
+		}
+
+		entry, err := store.Get(r.PathValue("id"))
 		if err != nil {
-			http.Error(w, "invalid ID", http.StatusBadRequest)
+			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
-		http.ServeFile(w, r, path)
+		serveObject(w, r, store, box, entry.Filename, entry.SHA256, entry.Encrypted, entry.ReceivedAt)
 	}
 }
 
-func handleFileAsset(store *Store) http.HandlerFunc {
+func handleFileAsset(store *Store, box *ecdh.PrivateKey) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		id := r.PathValue("id")
 		assetPath := r.PathValue("path")
+		if !fs.ValidPath(assetPath) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
 
-		dir, err := store.ContentDirPath(id)
+		entry, err := store.Get(r.PathValue("id"))
 		if err != nil {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+		sha, ok := entry.asset(assetPath)
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		serveObject(w, r, store, box, assetPath, sha, entry.sealed(assetPath), entry.ReceivedAt)
+	}
+}
 
-		// Sanitize: only allow base filename, no path traversal
-		safeName := filepath.Base(assetPath)
-		fullPath := filepath.Join(dir, safeName)
-		http.ServeFile(w, r, fullPath)
+// serveObject serves stored content. The content type comes from name, and
+// the SHA256 doubles as the ETag. Content the sender declared encrypted is
+// decrypted with box, and only for browsers on this machine.
+func serveObject(w http.ResponseWriter, r *http.Request, store *Store, box *ecdh.PrivateKey, name, sha string, sealed bool, modtime time.Time) {
+	f, err := os.Open(store.ObjectPath(sha))
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	var content io.ReadSeeker = f
+	if sealed {
+		// A name rebound to 127.0.0.1 would let another site read it.
+		if !isLoopback(r.RemoteAddr) || !isLoopbackHost(r.Host) {
+			http.Error(w, "encrypted: only viewable on the receiver", http.StatusForbidden)
+			return
+		}
+		sr, err := openSealed(f, box)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		content = sr
+		w.Header().Set("Cache-Control", "no-store")
 	}
+
+	w.Header().Set("ETag", `"`+sha+`"`)
+	http.ServeContent(w, r, path.Base(name), modtime, content)
 }
 
-func handleReceiveAssets(store *Store, broker *SSEBroker) http.HandlerFunc {
+func handleVersions(store *Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseMultipartForm(50 << 20); err != nil {
-			jsonError(w, "parse form: "+err.Error(), http.StatusBadRequest)
+		id := r.PathValue("id")
+		if _, err := store.Get(id); err != nil {
+			jsonError(w, "file not found", http.StatusNotFound)
 			return
 		}
 
-		sender := r.FormValue("sender")
-		if sender == "" {
-			sender = "unknown"
+		versions, err := store.Versions(id)
+		if err != nil {
+			jsonError(w, "list versions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+	}
+}
+
+// handleVersionRaw serves an archived revision's HTML. Assets are not
+// versioned, so relative references resolve to the current ones.
+func handleVersionRaw(store *Store, box *ecdh.PrivateKey) http.HandlerFunc {
+	serveAsset := handleFileAsset(store, box)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("path") != "" {
+			serveAsset(w, r)
+			return
 		}
 
-		htmlFilename := r.FormValue("for")
-		if htmlFilename == "" {
-			jsonError(w, "missing 'for' field (HTML filename)", http.StatusBadRequest)
+		rev, err := strconv.Atoi(r.PathValue("rev"))
+		if err != nil {
+			http.Error(w, "invalid revision", http.StatusBadRequest)
 			return
 		}
 
-		entry := store.FindByFilenameAndSender(htmlFilename, sender)
-		if entry == nil {
-			jsonError(w, fmt.Sprintf("no file %q from sender %q found", htmlFilename, sender), http.StatusNotFound)
+		v, err := store.Version(r.PathValue("id"), rev)
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+		serveObject(w, r, store, box, v.Filename, v.SHA256, v.Encrypted, v.ReceivedAt)
+	}
+}
 
-		// Collect all uploaded asset files
-		var assetNames []string
-		fhs := r.MultipartForm.File["files"]
-		for _, fh := range fhs {
-			f, err := fh.Open()
-			if err != nil {
-				jsonError(w, "open uploaded file: "+err.Error(), http.StatusInternalServerError)
-				return
+func handleVersionRestore(store *Store, broker *SSEBroker, acl *ACL) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		rev, err := strconv.Atoi(r.PathValue("rev"))
+		if err != nil {
+			jsonError(w, "invalid revision", http.StatusBadRequest)
+			return
+		}
+
+		entry, err := store.Get(id)
+		if err != nil {
+			jsonError(w, "file not found", http.StatusNotFound)
+			return
+		}
+		if err := acl.policy(r).restore(r, entry); err != nil {
+			aclError(w, err)
+			return
+		}
+
+		if _, err := store.Version(id, rev); err != nil {
+			jsonError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		restored, err := store.Restore(id, rev)
+		if err != nil {
+			jsonError(w, "restore: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Restored %q to revision %d (now revision %d)", restored.Filename, rev, restored.Revision)
+		broker.PublishUpdate(restored)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"ok": true, "id": restored.ID, "revision": restored.Revision})
+	}
+}
+
+func handleReceiveAssets(store *Store, broker *SSEBroker, acl *ACL, maxSize int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy := acl.policy(r)
+		if err := policy.push(); err != nil {
+			aclError(w, err)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		mr, err := r.MultipartReader()
+		if err != nil {
+			jsonError(w, "parse form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Assets are staged in temporary files as they stream in and only
+		// added to the entry once the whole request has been read.
+		var staged []*StagedAsset
+		defer func() {
+			for _, a := range staged {
+				a.Discard()
+			}
+		}()
+
+		var sender, htmlFilename, pendingPath string
+		var encrypted bool
+		var entry *FileEntry
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
 			}
-			data, err := io.ReadAll(f)
-			f.Close()
 			if err != nil {
-				jsonError(w, "read uploaded file: "+err.Error(), http.StatusInternalServerError)
+				uploadError(w, "parse form", err)
 				return
 			}
 
-			if err := store.SaveAsset(entry.ID, fh.Filename, data); err != nil {
-				jsonError(w, "save asset: "+err.Error(), http.StatusInternalServerError)
-				return
+			switch part.FormName() {
+			case "sender", "for", "paths", "encrypted":
+				value, err := readFormField(part)
+				if err != nil {
+					uploadError(w, "read "+part.FormName(), err)
+					return
+				}
+				switch part.FormName() {
+				case "sender":
+					sender = value
+				case "for":
+					htmlFilename = value
+				case "paths":
+					pendingPath = value
+				case "encrypted":
+					encrypted = value == "true"
+				}
+
+			case "files":
+				if entry == nil {
+					if sender == "" {
+						sender = "unknown"
+					}
+					if htmlFilename == "" {
+						jsonError(w, "missing 'for' field (HTML filename)", http.StatusBadRequest)
+						return
+					}
+					entry = store.FindByFilenameAndSender(htmlFilename, sender, senderKey(r))
+					if entry == nil {
+						jsonError(w, fmt.Sprintf("no file %q from sender %q found", htmlFilename, sender), http.StatusNotFound)
+						return
+					}
+				}
+
+				// Multipart filenames are reduced to their base name, so a
+				// relative path travels in a "paths" field before each file.
+				name := part.FileName()
+				if pendingPath != "" {
+					name = pendingPath
+					pendingPath = ""
+				}
+
+				if err := policy.file(name, -1); err != nil {
+					aclError(w, err)
+					return
+				}
+				a, err := store.StageAsset(entry.ID, name, policy.limitReader(part))
+				if err != nil {
+					uploadError(w, "save asset", err)
+					return
+				}
+				staged = append(staged, a)
+				if err := policy.file(name, a.Size()); err != nil {
+					aclError(w, err)
+					return
+				}
 			}
+		}
+
+		if err := finishBody(r); err != nil {
+			uploadError(w, "read body", err)
+			return
+		}
 
-			assetNames = append(assetNames, filepath.Base(fh.Filename))
-			log.Printf("Saved asset %q for %q from %s", fh.Filename, htmlFilename, sender)
+		if entry == nil {
+			jsonError(w, "no files uploaded", http.StatusBadRequest)
+			return
+		}
+
+		unlock := store.LockEntry(entry.ID)
+		defer unlock()
+		if entry, err = store.Get(entry.ID); err != nil {
+			jsonError(w, "file was deleted during upload", http.StatusNotFound)
+			return
+		}
+
+		if entry, err = store.CommitAssets(entry.ID, staged, encrypted); err != nil {
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var assetNames []string
+		for _, a := range staged {
+			assetNames = append(assetNames, a.Name)
+			log.Printf("Saved asset %q for %q from %s", a.Name, htmlFilename, sender)
 		}
 
 		// Rewrite URLs in the HTML file
-		if len(assetNames) > 0 {
-			if err := rewriteHTMLUrls(store, entry, assetNames); err != nil {
+		if len(assetNames) > 0 && !entry.Encrypted {
+			rewritten, err := rewriteHTMLUrls(store, entry, assetNames)
+			if err != nil {
 				log.Printf("Warning: failed to rewrite HTML URLs: %v", err)
+			} else {
+				entry = rewritten
 			}
 		}
 
@@ -290,32 +752,72 @@ func handleReceiveAssets(store *Store, broker *SSEBroker) http.HandlerFunc {
 	}
 }
 
-func rewriteHTMLUrls(store *Store, entry *FileEntry, assetNames []string) error {
-	htmlPath, err := store.FilePath(entry.ID)
-	if err != nil {
-		return err
-	}
-
-	data, err := os.ReadFile(htmlPath)
+// rewriteHTMLUrls points references at assets that were uploaded without a
+// directory (e.g. by older clients) to the flat file. Assets uploaded with
+// their relative path are served as-is and need no rewriting, and references
+// that already resolve to a stored asset are left alone. The caller holds
+// the entry's lock.
+func rewriteHTMLUrls(store *Store, entry *FileEntry, assetNames []string) (*FileEntry, error) {
+	data, err := os.ReadFile(store.ObjectPath(entry.SHA256))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	content := string(data)
 	for _, name := range assetNames {
+		if strings.Contains(name, "/") {
+			continue
+		}
+
 		// Match src="...name" or href="...name" and replace the path with just the filename
 		pattern := `((?:src|href)\s*=\s*["'])([^"']*` + regexp.QuoteMeta(name) + `)(["'])`
 		re := regexp.MustCompile(pattern)
-		content = re.ReplaceAllString(content, "${1}"+name+"${3}")
+		content = re.ReplaceAllStringFunc(content, func(m string) string {
+			parts := re.FindStringSubmatch(m)
+			if ref, ok := localRef(parts[2]); ok {
+				if _, ok := entry.asset(ref); ok {
+					return m
+				}
+			}
+			return parts[1] + name + parts[3]
+		})
+	}
+
+	if content == string(data) {
+		return entry, nil
 	}
+	return store.ReplaceHTML(entry.ID, []byte(content))
+}
+
+func handleEncryptionKey(key encryptionKey) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(key)
+	}
+}
 
-	return os.WriteFile(htmlPath, []byte(content), 0644)
+// healthResponse is returned by GET /health. Receivers before version,
+// files and disk_usage were added only send name and status.
+type healthResponse struct {
+	Name      string   `json:"name"`
+	Status    string   `json:"status"`
+	Version   string   `json:"version,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Files     int      `json:"files"`
+	DiskUsage int64    `json:"disk_usage"` // bytes of stored contents
 }
 
-func handleHealth(name string) http.HandlerFunc {
+func handleHealth(name string, tags []string, store *Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"name": name, "status": "ok"})
+		json.NewEncoder(w).Encode(healthResponse{
+			Name:      name,
+			Status:    "ok",
+			Version:   version,
+			Tags:      tags,
+			Files:     store.Count(),
+			DiskUsage: store.DiskUsage(),
+		})
 	}
 }
 
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// newTestServer serves the receive, delete and restore handlers on an open
+// receiver, without acl.conf or authentication.
+func newTestServer(t *testing.T, store *Store) *httptest.Server {
+	t.Helper()
+	dir := t.TempDir()
+	paired, err := LoadPairedSenders(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := LoadACL(dir, paired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := NewSSEBroker()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /receive", handleReceive(store, broker, acl, 1<<20))
+	mux.HandleFunc("DELETE /files/{id}", handleFileDelete(store, broker, acl))
+	mux.HandleFunc("POST /files/{id}/versions/{rev}/restore", handleVersionRestore(store, broker, acl))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// call sends a request and decodes the JSON reply into result, failing the
+// test unless the status is 200.
+func call(t *testing.T, req *http.Request, result any) bool {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct{ Error string }
+		json.NewDecoder(resp.Body).Decode(&e)
+		t.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, e.Error)
+		return false
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Errorf("%s %s: %v", req.Method, req.URL.Path, err)
+		return false
+	}
+	return true
+}
+
+func receive(t *testing.T, srv *httptest.Server, filename, sender, content string) string {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("sender", sender)
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	mw.Close()
+
+	req, err := http.NewRequest("POST", srv.URL+"/receive", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var result struct{ ID string }
+	if !call(t, req, &result) {
+		return ""
+	}
+	return result.ID
+}
+
+func TestServeConcurrentReceive(t *testing.T) {
+	const files, pushes = 10, 8
+	store := newTestStore(t, pushes)
+	srv := newTestServer(t, store)
+
+	var wg sync.WaitGroup
+	for f := range files {
+		for p := range pushes {
+			wg.Go(func() {
+				receive(t, srv, fmt.Sprintf("page-%d.html", f), "laptop", fmt.Sprintf("<p>%d.%d</p>", f, p))
+			})
+		}
+	}
+	wg.Wait()
+
+	entries, _ := store.List(ListOptions{})
+	if len(entries) != files {
+		t.Fatalf("store has %d entries, want %d", len(entries), files)
+	}
+	for _, e := range entries {
+		if e.Revision != pushes {
+			t.Errorf("%s is at revision %d, want %d", e.Filename, e.Revision, pushes)
+		}
+		versions, err := store.Versions(e.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != pushes-1 {
+			t.Errorf("%s has %d versions, want %d", e.Filename, len(versions), pushes-1)
+		}
+	}
+}
+
+func TestServeConcurrentDeleteAndReceive(t *testing.T) {
+	const doomed, kept, pushes = 12, 6, 4
+	store := newTestStore(t, pushes)
+	srv := newTestServer(t, store)
+
+	var ids []string
+	for i := range doomed {
+		ids = append(ids, receive(t, srv, fmt.Sprintf("old-%d.html", i), "laptop", fmt.Sprintf("<p>old %d</p>", i)))
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		// Deleting an entry twice at once must not fail or release its
+		// contents twice.
+		for range 2 {
+			wg.Go(func() {
+				req, err := http.NewRequest("DELETE", srv.URL+"/files/"+id, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+					t.Errorf("DELETE %s: %s", id, resp.Status)
+				}
+			})
+		}
+	}
+	for i := range kept {
+		for p := range pushes {
+			wg.Go(func() {
+				receive(t, srv, fmt.Sprintf("new-%d.html", i), "laptop", fmt.Sprintf("<p>new %d.%d</p>", i, p))
+			})
+		}
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		if _, err := store.Get(id); err == nil {
+			t.Errorf("deleted entry %s is still there", id)
+		}
+	}
+	entries, _ := store.List(ListOptions{})
+	if len(entries) != kept {
+		t.Fatalf("store has %d entries, want %d", len(entries), kept)
+	}
+	for _, e := range entries {
+		if e.Revision != pushes {
+			t.Errorf("%s is at revision %d, want %d", e.Filename, e.Revision, pushes)
+		}
+	}
+
+	for _, e := range entries {
+		if err := store.Delete(e.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := store.DiskUsage(); n != 0 {
+		t.Errorf("disk usage after deleting everything = %d, want 0", n)
+	}
+}
+
+func TestServeConcurrentRestore(t *testing.T) {
+	const revisions, restores = 3, 20
+	store := newTestStore(t, revisions+restores)
+	srv := newTestServer(t, store)
+
+	var id string
+	for r := range revisions {
+		id = receive(t, srv, "page.html", "laptop", fmt.Sprintf("<p>%d</p>", r))
+	}
+
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+	var wg sync.WaitGroup
+	for i := range restores {
+		wg.Go(func() {
+			url := fmt.Sprintf("%s/files/%s/versions/%d/restore", srv.URL, id, 1+i%(revisions-1))
+			req, err := http.NewRequest("POST", url, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var result struct{ Revision int }
+			if !call(t, req, &result) {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if seen[result.Revision] {
+				t.Errorf("two restores produced revision %d", result.Revision)
+			}
+			seen[result.Revision] = true
+		})
+	}
+	wg.Wait()
+
+	entry, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := revisions + restores; entry.Revision != want {
+		t.Errorf("revision = %d, want %d", entry.Revision, want)
+	}
+	versions, err := store.Versions(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := revisions + restores - 1; len(versions) != want {
+		t.Errorf("%d versions kept, want %d", len(versions), want)
+	}
+}
@@ -43,6 +43,16 @@ func (b *SSEBroker) PublishRemoval(id string) {
 	b.send("file-removed", map[string]string{"id": id})
 }
 
+// PublishPairRequest tells the web UI a sender wants to pair. The code is
+// left out: anyone on the network can listen to /events.
+func (b *SSEBroker) PublishPairRequest(id, name string) {
+	b.send("pair-requested", map[string]string{"id": id, "name": name})
+}
+
+func (b *SSEBroker) PublishPairDone(id string) {
+	b.send("pair-done", map[string]string{"id": id})
+}
+
 func (b *SSEBroker) send(event string, payload any) {
 	data, _ := json.Marshal(payload)
 	msg := fmt.Sprintf("event: %s\ndata: %s\n\n", event, data)
@@ -1,14 +1,18 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
-	"sort"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -18,149 +22,349 @@ type FileEntry struct {
 	ID         string    `json:"id"`
 	Filename   string    `json:"filename"`
 	Sender     string    `json:"sender"`
+	SenderKey  string    `json:"sender_key,omitempty"` // node key the push was signed with
 	ReceivedAt time.Time `json:"received_at"`
 	Size       int64     `json:"size"`
 	SHA256     string    `json:"sha256"`
-	ContentDir string    `json:"content_dir"`
+	Revision   int       `json:"revision"`
+	Encrypted  bool      `json:"encrypted,omitempty"` // the sender declared the page encrypted (-encrypt)
+
+	// Assets maps each asset's path relative to the page to the SHA256 of
+	// its content in the object store. EncryptedAssets lists, sorted, the
+	// paths of those the sender declared encrypted.
+	Assets          map[string]string `json:"assets,omitempty"`
+	EncryptedAssets []string          `json:"encrypted_assets,omitempty"`
+
+	// ContentDir is only set on entries stored before the object store,
+	// which kept the page and its assets in {id}/{ContentDir}/.
+	ContentDir string `json:"content_dir,omitempty"`
+}
+
+// asset returns the SHA256 of the file served at path relative to the page:
+// an uploaded asset, or the page itself.
+func (e *FileEntry) asset(path string) (string, bool) {
+	if sha, ok := e.Assets[path]; ok {
+		return sha, true
+	}
+	if path == e.Filename {
+		return e.SHA256, true
+	}
+	return "", false
+}
+
+// sealed reports whether the file served at path was pushed encrypted.
+func (e *FileEntry) sealed(path string) bool {
+	if _, ok := e.Assets[path]; ok {
+		_, found := slices.BinarySearch(e.EncryptedAssets, path)
+		return found
+	}
+	return path == e.Filename && e.Encrypted
 }
 
 type Store struct {
-	baseDir string
+	baseDir      string
+	tmpDir       string
+	keepVersions int
+	index        *storeIndex
+	objects      *objectStore
+	paired       *TrustedKeys // senders who may take over their name's unsigned entries
+
+	// locks serializes writes to the same entry ("id:<id>") and the
+	// lookup-or-create of a filename and owner ("name:<filename>\x00<owner>").
+	// A name lock is always taken before an id lock.
+	locks keyedMutex
 }
 
-func NewStore(dataDir string) (*Store, error) {
+// NewStore opens the store under dataDir. Entries live in files/{id}/ and
+// their contents in the shared object store. Re-pushing a file keeps up to
+// keepVersions previous revisions of its HTML; 0 disables history. A
+// sender in paired, which may be nil, takes over the files pushed unsigned
+// under the name it was paired as. The data directory stays locked until
+// the process exits, and NewStore fails if another process has it open.
+func NewStore(dataDir string, keepVersions int, paired *TrustedKeys) (*Store, error) {
 	filesDir := filepath.Join(dataDir, "files")
 	if err := os.MkdirAll(filesDir, 0755); err != nil {
 		return nil, fmt.Errorf("create storage dir: %w", err)
 	}
-	return &Store{baseDir: filesDir}, nil
+	if err := lockDataDir(dataDir); err != nil {
+		return nil, err
+	}
+	tmpDir := filepath.Join(dataDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	objects, err := newObjectStore(dataDir, tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{baseDir: filesDir, tmpDir: tmpDir, keepVersions: keepVersions, index: newStoreIndex(), objects: objects, paired: paired}
+	s.recover()
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-// Save stores a file. If a file with the same filename and sender already exists,
-// it updates that entry in place. Returns the entry and whether it was an update.
-func (s *Store) Save(filename, sender string, data []byte) (*FileEntry, bool, error) {
-	hash := sha256.Sum256(data)
-	hashHex := hex.EncodeToString(hash[:])
-	now := time.Now()
+// loadIndex reads every entry's metadata into the in-memory index, moving
+// entries in older layouts into the object store, and counts the references
+// to each blob.
+func (s *Store) loadIndex() error {
+	entries, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return fmt.Errorf("read storage dir: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !validID.MatchString(e.Name()) {
+			continue
+		}
+		entry, err := s.readMeta(e.Name())
+		if err != nil {
+			continue
+		}
+		if entry, err = s.migrate(entry); err != nil {
+			log.Printf("Warning: cannot migrate %s: %v", e.Name(), err)
+			continue
+		}
+		if _, err := os.Stat(s.ObjectPath(entry.SHA256)); err != nil {
+			log.Printf("Warning: skipping %s: content missing", entry.ID)
+			continue
+		}
 
-	// Check for existing file with same filename+sender
-	if existing := s.FindByFilenameAndSender(filename, sender); existing != nil {
-		return s.update(existing.ID, filename, sender, data, hashHex, now)
+		s.index.put(entry)
+		s.objects.retain(entry.SHA256)
+		for _, sha := range entry.Assets {
+			s.objects.retain(sha)
+		}
+		versions, _ := s.Versions(entry.ID)
+		for _, v := range versions {
+			s.objects.retain(v.SHA256)
+		}
 	}
+	return nil
+}
 
-	id := fmt.Sprintf("%s-%s", now.Format("20060102-150405"), hashHex[:6])
+// Save moves a finished upload into the store. If the same sender already
+// sent a file with this filename, it updates that entry, archiving the
+// previous revision. senderKey is the sender's verified node key, if the
+// push was signed; see owner. Returns the entry and whether it was an update.
+func (s *Store) Save(filename, sender, senderKey string, encrypted bool, u *Upload) (*FileEntry, bool, error) {
+	now := time.Now()
 
-	contentDir := filenameWithoutExt(filename)
-	entryDir := filepath.Join(s.baseDir, id)
-	contentPath := filepath.Join(entryDir, contentDir)
-	if err := os.MkdirAll(contentPath, 0755); err != nil {
-		return nil, false, fmt.Errorf("create content dir: %w", err)
+	unlockName := s.locks.Lock("name:" + nameKey(filename, owner(sender, senderKey)))
+	defer unlockName()
+
+	// Check for existing file with same filename+owner
+	if found := s.FindByFilenameAndSender(filename, sender, senderKey); found != nil {
+		unlock := s.LockEntry(found.ID)
+		defer unlock()
+		// It may have been deleted, or taken over by another key, while we
+		// waited for the lock.
+		if existing, err := s.Get(found.ID); err == nil && existing.SenderKey == found.SenderKey {
+			// update rewrites meta.json and re-indexes the entry under
+			// its new owner.
+			existing.SenderKey = senderKey
+			return s.update(existing, u, encrypted, now)
+		}
 	}
 
-	filePath := filepath.Join(contentPath, filename)
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
-		return nil, false, fmt.Errorf("write file: %w", err)
+	id, err := s.newEntryDir(now, u.SHA256())
+	if err != nil {
+		return nil, false, err
+	}
+	unlock := s.LockEntry(id)
+	defer unlock()
+
+	sha, err := s.objects.acquire(u)
+	if err != nil {
+		return nil, false, err
 	}
 
 	entry := &FileEntry{
 		ID:         id,
 		Filename:   filename,
 		Sender:     sender,
+		SenderKey:  senderKey,
 		ReceivedAt: now,
-		Size:       int64(len(data)),
-		SHA256:     hashHex,
-		ContentDir: contentDir,
+		Size:       u.Size(),
+		SHA256:     sha,
+		Revision:   1,
+		Encrypted:  encrypted,
 	}
 
-	metaPath := filepath.Join(entryDir, "meta.json")
-	metaData, err := json.MarshalIndent(entry, "", "  ")
-	if err != nil {
-		return nil, false, fmt.Errorf("marshal metadata: %w", err)
-	}
-	if err := os.WriteFile(metaPath, metaData, 0644); err != nil {
-		return nil, false, fmt.Errorf("write metadata: %w", err)
+	// meta.json is written last: an entry only exists once its metadata
+	// does, and recover() removes entry directories without it.
+	if err := s.writeMeta(entry); err != nil {
+		s.objects.release(sha)
+		return nil, false, err
 	}
+	s.index.put(entry)
 
 	return entry, false, nil
 }
 
-func (s *Store) update(id, filename, sender string, data []byte, hashHex string, now time.Time) (*FileEntry, bool, error) {
-	contentDir := filenameWithoutExt(filename)
-	entryDir := filepath.Join(s.baseDir, id)
-	contentPath := filepath.Join(entryDir, contentDir)
-	if err := os.MkdirAll(contentPath, 0755); err != nil {
-		return nil, false, fmt.Errorf("create content dir: %w", err)
+// newEntryDir creates the directory for a new entry and returns its ID.
+// IDs are made of the time and the content hash, so two different files
+// with the same content pushed in the same second would collide; the later
+// one moves on to the next free second.
+func (s *Store) newEntryDir(now time.Time, sha string) (string, error) {
+	for {
+		id := fmt.Sprintf("%s-%s", now.Format("20060102-150405"), sha[:6])
+		err := os.Mkdir(filepath.Join(s.baseDir, id), 0755)
+		if err == nil {
+			return id, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", fmt.Errorf("create entry dir: %w", err)
+		}
+		now = now.Add(time.Second)
 	}
+}
 
-	filePath := filepath.Join(contentPath, filename)
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
-		return nil, false, fmt.Errorf("write file: %w", err)
-	}
+// LockEntry serializes changes to an entry and returns the function that
+// releases it. Store methods that write an entry take the lock themselves;
+// callers that write into an entry directly (assets, rewritten HTML) must
+// hold it.
+func (s *Store) LockEntry(id string) func() {
+	return s.locks.Lock("id:" + id)
+}
 
-	entry := &FileEntry{
-		ID:         id,
-		Filename:   filename,
-		Sender:     sender,
-		ReceivedAt: now,
-		Size:       int64(len(data)),
-		SHA256:     hashHex,
-		ContentDir: contentDir,
+// update replaces the HTML of an existing entry. The caller holds the
+// entry's lock.
+func (s *Store) update(existing *FileEntry, u *Upload, encrypted bool, now time.Time) (*FileEntry, bool, error) {
+	if err := s.archive(existing); err != nil {
+		return nil, false, err
 	}
 
-	metaPath := filepath.Join(entryDir, "meta.json")
-	metaData, err := json.MarshalIndent(entry, "", "  ")
+	sha, err := s.objects.acquire(u)
 	if err != nil {
-		return nil, false, fmt.Errorf("marshal metadata: %w", err)
+		return nil, false, err
 	}
-	if err := os.WriteFile(metaPath, metaData, 0644); err != nil {
-		return nil, false, fmt.Errorf("write metadata: %w", err)
+
+	entry := *existing
+	entry.ReceivedAt = now
+	entry.Size = u.Size()
+	entry.SHA256 = sha
+	entry.Revision = existing.revision() + 1
+	entry.Encrypted = encrypted
+
+	if err := s.writeMeta(&entry); err != nil {
+		s.objects.release(sha)
+		return nil, false, err
+	}
+	s.index.put(&entry)
+	s.objects.release(existing.SHA256)
+
+	if err := s.pruneVersions(entry.ID); err != nil {
+		return nil, false, err
 	}
 
-	return entry, true, nil
+	return &entry, true, nil
 }
 
-func (s *Store) FindByFilenameAndSender(filename, sender string) *FileEntry {
-	entries, err := s.List()
+// ReplaceHTML overwrites the current HTML of an entry without archiving a
+// revision. The caller holds the entry's lock.
+func (s *Store) ReplaceHTML(id string, data []byte) (*FileEntry, error) {
+	existing, err := s.Get(id)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	for _, e := range entries {
-		if e.Filename == filename && e.Sender == sender {
-			return &e
-		}
+
+	u, err := s.NewUpload()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer u.Discard()
+	if _, err := u.Write(data); err != nil {
+		return nil, fmt.Errorf("write file: %w", err)
+	}
+	sha, err := s.objects.acquire(u)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := *existing
+	entry.Size = u.Size()
+	entry.SHA256 = sha
+	if err := s.writeMeta(&entry); err != nil {
+		s.objects.release(sha)
+		return nil, err
+	}
+	s.index.put(&entry)
+	s.objects.release(existing.SHA256)
+	return &entry, nil
 }
 
-func (s *Store) List() ([]FileEntry, error) {
-	entries, err := os.ReadDir(s.baseDir)
+func (s *Store) writeMeta(entry *FileEntry) error {
+	metaData, err := json.MarshalIndent(entry, "", "  ")
 	if err != nil {
-		return nil, fmt.Errorf("read storage dir: %w", err)
+		return fmt.Errorf("marshal metadata: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(s.baseDir, entry.ID, "meta.json"), metaData, 0644); err != nil {
+		return fmt.Errorf("write metadata: %w", err)
 	}
+	return nil
+}
 
-	var files []FileEntry
-	for _, e := range entries {
-		if !e.IsDir() || !validID.MatchString(e.Name()) {
-			continue
-		}
-		entry, err := s.Get(e.Name())
-		if err != nil {
-			continue
-		}
-		files = append(files, *entry)
+// FindByFilenameAndSender returns the file with this filename from the
+// sender with this key, or from an unsigned sender with this name if
+// senderKey is empty. A sender paired under that name, with no file of its
+// own by that name, gets the one its name pushed before it signed its
+// requests, which Save then hands over to its key. Any other key claiming
+// the name gets nothing, so it can't take over that machine's files.
+func (s *Store) FindByFilenameAndSender(filename, sender, senderKey string) *FileEntry {
+	entry, ok := s.index.findByName(filename, owner(sender, senderKey))
+	if !ok && s.adopts(sender, senderKey) {
+		entry, ok = s.index.findByName(filename, owner(sender, ""))
+	}
+	if !ok {
+		return nil
 	}
+	return &entry
+}
 
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].ReceivedAt.After(files[j].ReceivedAt)
-	})
+// adopts reports whether senderKey was paired under the name sender, and so
+// may take over the files pushed unsigned under that name.
+func (s *Store) adopts(sender, senderKey string) bool {
+	return senderKey != "" && s.paired != nil && strings.EqualFold(s.paired.Name(senderKey), sender)
+}
 
-	return files, nil
+// FindBySHA256 returns the entries whose HTML has the given SHA256.
+func (s *Store) FindBySHA256(sha string) []FileEntry {
+	return s.index.findBySHA256(sha)
+}
+
+// List returns the entries selected by opts and the total number of entries.
+func (s *Store) List(opts ListOptions) ([]FileEntry, int) {
+	return s.index.list(opts)
+}
+
+// Count returns the number of entries.
+func (s *Store) Count() int {
+	return s.index.count()
+}
+
+// DiskUsage returns the total size of the stored pages, assets and
+// revisions. Metadata isn't counted; it is small next to the contents.
+func (s *Store) DiskUsage() int64 {
+	return s.objects.diskUsage()
 }
 
 func (s *Store) Get(id string) (*FileEntry, error) {
 	if !validID.MatchString(id) {
 		return nil, fmt.Errorf("invalid file ID")
 	}
+	entry, ok := s.index.get(id)
+	if !ok {
+		return nil, fmt.Errorf("file not found")
+	}
+	return &entry, nil
+}
+
+// readMeta reads an entry's metadata from disk.
+func (s *Store) readMeta(id string) (*FileEntry, error) {
+	if !validID.MatchString(id) {
+		return nil, fmt.Errorf("invalid file ID")
+	}
 
 	metaPath := filepath.Join(s.baseDir, id, "meta.json")
 	data, err := os.ReadFile(metaPath)
@@ -180,57 +384,150 @@ func (s *Store) Delete(id string) error {
 	if !validID.MatchString(id) {
 		return fmt.Errorf("invalid file ID")
 	}
+	unlock := s.LockEntry(id)
+	defer unlock()
+
+	// Collect the blobs the entry references before its metadata is gone.
+	var refs []string
+	if entry, err := s.Get(id); err == nil {
+		refs = append(refs, entry.SHA256)
+		for _, sha := range entry.Assets {
+			refs = append(refs, sha)
+		}
+		versions, _ := s.Versions(id)
+		for _, v := range versions {
+			refs = append(refs, v.SHA256)
+		}
+	}
+
+	s.index.remove(id)
 	entryDir := filepath.Join(s.baseDir, id)
 	if err := os.RemoveAll(entryDir); err != nil {
 		return fmt.Errorf("delete entry: %w", err)
 	}
+
+	for _, sha := range refs {
+		s.objects.release(sha)
+	}
 	return nil
 }
 
-func (s *Store) FilePath(id string) (string, error) {
-	if !validID.MatchString(id) {
-		return "", fmt.Errorf("invalid file ID")
-	}
+// ObjectPath returns where the content with the given SHA256 is stored.
+func (s *Store) ObjectPath(sha string) string {
+	return s.objects.path(sha)
+}
 
-	// Try new structure first: {id}/{contentDir}/{filename}
-	entry, err := s.Get(id)
-	if err == nil && entry.ContentDir != "" {
-		return filepath.Join(s.baseDir, id, entry.ContentDir, entry.Filename), nil
-	}
+// GC removes stored contents that no entry references any more. Contents
+// written within grace are kept.
+func (s *Store) GC(grace time.Duration, dryRun bool) (int, int64, error) {
+	return s.objects.gc(grace, dryRun)
+}
 
-	// Backward compat: old entries stored as original.html
-	return filepath.Join(s.baseDir, id, "original.html"), nil
+// StagedAsset is an asset that has been received but not yet added to its
+// entry.
+type StagedAsset struct {
+	Name string // slash-separated path relative to the page
+	u    *Upload
 }
 
-func (s *Store) ContentDirPath(id string) (string, error) {
-	if !validID.MatchString(id) {
-		return "", fmt.Errorf("invalid file ID")
+// StageAsset streams an asset into a temporary file. CommitAssets adds it to
+// the entry under its relative path (e.g. "img/logo.png"); Discard removes it.
+func (s *Store) StageAsset(id string, assetPath string, r io.Reader) (*StagedAsset, error) {
+	name, err := cleanAssetPath(assetPath)
+	if err != nil {
+		return nil, err
 	}
 
 	entry, err := s.Get(id)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if name == entry.Filename {
+		return nil, fmt.Errorf("asset %q would overwrite the page", assetPath)
+	}
+
+	u, err := s.NewUpload()
+	if err != nil {
+		return nil, err
 	}
-	if entry.ContentDir == "" {
-		return "", fmt.Errorf("entry has no content directory")
+	if _, err := io.Copy(u, r); err != nil {
+		u.Discard()
+		return nil, err
 	}
+	return &StagedAsset{Name: filepath.ToSlash(name), u: u}, nil
+}
+
+func (a *StagedAsset) Size() int64 {
+	return a.u.Size()
+}
 
-	return filepath.Join(s.baseDir, id, entry.ContentDir), nil
+func (a *StagedAsset) Discard() {
+	a.u.Discard()
 }
 
-func (s *Store) SaveAsset(id string, assetName string, data []byte) error {
-	dir, err := s.ContentDirPath(id)
+// CommitAssets adds staged assets to an entry, replacing assets with the
+// same path, and records whether the sender declared them encrypted. The
+// caller holds the entry's lock and still discards the staged assets
+// afterwards.
+func (s *Store) CommitAssets(id string, staged []*StagedAsset, encrypted bool) (*FileEntry, error) {
+	existing, err := s.Get(id)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Sanitize: only use the base name to prevent path traversal
-	safeName := filepath.Base(assetName)
-	assetPath := filepath.Join(dir, safeName)
-	return os.WriteFile(assetPath, data, 0644)
+	entry := *existing
+	entry.Assets = maps.Clone(existing.Assets)
+	if entry.Assets == nil {
+		entry.Assets = make(map[string]string)
+	}
+
+	var acquired, replaced []string
+	for _, a := range staged {
+		sha, err := s.objects.acquire(a.u)
+		if err != nil {
+			for _, sha := range acquired {
+				s.objects.release(sha)
+			}
+			return nil, fmt.Errorf("save asset %q: %w", a.Name, err)
+		}
+		acquired = append(acquired, sha)
+		if old, ok := entry.Assets[a.Name]; ok {
+			replaced = append(replaced, old)
+		}
+		entry.Assets[a.Name] = sha
+	}
+
+	entry.EncryptedAssets = slices.DeleteFunc(slices.Clone(existing.EncryptedAssets), func(name string) bool {
+		return slices.ContainsFunc(staged, func(a *StagedAsset) bool { return a.Name == name })
+	})
+	if encrypted {
+		for _, a := range staged {
+			entry.EncryptedAssets = append(entry.EncryptedAssets, a.Name)
+		}
+		slices.Sort(entry.EncryptedAssets)
+		entry.EncryptedAssets = slices.Compact(entry.EncryptedAssets)
+	}
+
+	if err := s.writeMeta(&entry); err != nil {
+		for _, sha := range acquired {
+			s.objects.release(sha)
+		}
+		return nil, err
+	}
+	s.index.put(&entry)
+
+	for _, sha := range replaced {
+		s.objects.release(sha)
+	}
+	return &entry, nil
 }
 
-func filenameWithoutExt(filename string) string {
-	ext := filepath.Ext(filename)
-	return filename[:len(filename)-len(ext)]
+// cleanAssetPath converts a slash-separated asset path into a local
+// filesystem path, rejecting absolute paths and anything containing "..".
+func cleanAssetPath(assetPath string) (string, error) {
+	name := filepath.Clean(filepath.FromSlash(assetPath))
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid asset path %q", assetPath)
+	}
+	return name, nil
 }
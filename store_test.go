@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func newTestStore(t *testing.T, keepVersions int) *Store {
+	t.Helper()
+	store, err := NewStore(t.TempDir(), keepVersions, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func saveString(t *testing.T, store *Store, filename, sender, content string) *FileEntry {
+	t.Helper()
+	u, err := store.NewUpload()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	defer u.Discard()
+	if _, err := u.Write([]byte(content)); err != nil {
+		t.Error(err)
+		return nil
+	}
+	entry, _, err := store.Save(filename, sender, "", false, u)
+	if err != nil {
+		t.Errorf("save %s: %v", filename, err)
+		return nil
+	}
+	return entry
+}
+
+func TestStoreConcurrentSaves(t *testing.T) {
+	const files, pushes = 8, 12
+	store := newTestStore(t, pushes)
+
+	var wg sync.WaitGroup
+	for f := range files {
+		for p := range pushes {
+			wg.Go(func() {
+				saveString(t, store, fmt.Sprintf("page-%d.html", f), "laptop", fmt.Sprintf("<p>%d.%d</p>", f, p))
+			})
+		}
+	}
+	wg.Wait()
+
+	if n := store.Count(); n != files {
+		t.Fatalf("store has %d entries, want %d", n, files)
+	}
+	for f := range files {
+		entry := store.FindByFilenameAndSender(fmt.Sprintf("page-%d.html", f), "laptop", "")
+		if entry == nil {
+			t.Fatalf("page-%d.html is missing", f)
+		}
+		if entry.Revision != pushes {
+			t.Errorf("%s is at revision %d, want %d", entry.Filename, entry.Revision, pushes)
+		}
+		versions, err := store.Versions(entry.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != pushes-1 {
+			t.Errorf("%s has %d versions, want %d", entry.Filename, len(versions), pushes-1)
+		}
+	}
+}
+
+func TestStoreConcurrentRestoreAndDelete(t *testing.T) {
+	const revisions, restores = 4, 16
+	store := newTestStore(t, revisions+restores)
+
+	var entry *FileEntry
+	for r := range revisions {
+		entry = saveString(t, store, "page.html", "laptop", fmt.Sprintf("<p>%d</p>", r))
+	}
+	var doomed []string
+	for i := range 10 {
+		doomed = append(doomed, saveString(t, store, fmt.Sprintf("old-%d.html", i), "laptop", fmt.Sprintf("<p>old %d</p>", i)).ID)
+	}
+
+	var wg sync.WaitGroup
+	seen := make(chan int, restores)
+	for i := range restores {
+		wg.Go(func() {
+			restored, err := store.Restore(entry.ID, 1+i%(revisions-1))
+			if err != nil {
+				t.Errorf("restore: %v", err)
+				return
+			}
+			seen <- restored.Revision
+		})
+	}
+	for _, id := range doomed {
+		for range 2 {
+			wg.Go(func() {
+				if err := store.Delete(id); err != nil {
+					t.Errorf("delete %s: %v", id, err)
+				}
+			})
+		}
+	}
+	wg.Wait()
+	close(seen)
+
+	// Every restore made a revision of its own.
+	got := make(map[int]bool)
+	for rev := range seen {
+		if got[rev] {
+			t.Errorf("two restores produced revision %d", rev)
+		}
+		got[rev] = true
+	}
+
+	entry, err := store.Get(entry.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := revisions + restores; entry.Revision != want {
+		t.Errorf("revision = %d, want %d", entry.Revision, want)
+	}
+	if n := store.Count(); n != 1 {
+		t.Errorf("store has %d entries, want 1", n)
+	}
+
+	// Deleting the rest must leave nothing behind: every blob was
+	// released exactly as often as it was taken.
+	if err := store.Delete(entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.DiskUsage(); n != 0 {
+		t.Errorf("disk usage after deleting everything = %d, want 0", n)
+	}
+}
+
+func TestStoreAdoptsUnsignedEntriesOnlyForPairedName(t *testing.T) {
+	dir := t.TempDir()
+	paired, err := LoadPairedSenders(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const laptopKey = "1111111111111111111111111111111111111111111111111111111111111111"
+	const otherKey = "2222222222222222222222222222222222222222222222222222222222222222"
+	if err := paired.Add(laptopKey, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(dir, 4, paired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save := func(sender, key, content string) *FileEntry {
+		t.Helper()
+		u, err := store.NewUpload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer u.Discard()
+		u.Write([]byte(content))
+		entry, _, err := store.Save("page.html", sender, key, false, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+
+	legacy := save("laptop", "", "<p>unsigned</p>")
+
+	// A key that claims the name without being paired under it gets an
+	// entry of its own.
+	if e := save("laptop", otherKey, "<p>other</p>"); e.ID == legacy.ID {
+		t.Fatalf("unpaired key took over %s", legacy.ID)
+	}
+	if e, err := store.Get(legacy.ID); err != nil || e.SenderKey != "" || e.Revision != 1 {
+		t.Fatalf("legacy entry changed: %+v, %v", e, err)
+	}
+
+	// The key paired as laptop takes it over.
+	e := save("laptop", laptopKey, "<p>signed</p>")
+	if e.ID != legacy.ID || e.SenderKey != laptopKey || e.Revision != 2 {
+		t.Fatalf("paired key got %+v, want %s at revision 2", e, legacy.ID)
+	}
+	if n := store.Count(); n != 2 {
+		t.Errorf("store has %d entries, want 2", n)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Upload is a file being streamed into the store. Data is written to a
+// temporary file and hashed as it arrives; Store.Save moves it into place.
+type Upload struct {
+	f       *os.File
+	hash    hash.Hash
+	size    int64
+	adopted bool // file belongs to the caller; Discard leaves it alone
+}
+
+func (s *Store) NewUpload() (*Upload, error) {
+	f, err := os.CreateTemp(s.tmpDir, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	return &Upload{f: f, hash: sha256.New()}, nil
+}
+
+// AdoptUpload wraps an existing, complete file (such as an assembled chunked
+// upload) so it can be passed to Save. The file is hashed up front. Unlike a
+// regular upload, Discard does not delete it.
+func (s *Store) AdoptUpload(path string) (*Upload, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open upload: %w", err)
+	}
+
+	u := &Upload{f: f, hash: sha256.New(), adopted: true}
+	n, err := io.Copy(u.hash, f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("hash upload: %w", err)
+	}
+	u.size = n
+	return u, nil
+}
+
+func (u *Upload) Write(p []byte) (int, error) {
+	n, err := u.f.Write(p)
+	u.hash.Write(p[:n])
+	u.size += int64(n)
+	return n, err
+}
+
+func (u *Upload) Size() int64 {
+	return u.size
+}
+
+func (u *Upload) SHA256() string {
+	return hex.EncodeToString(u.hash.Sum(nil))
+}
+
+// Discard removes the temporary file. It is safe to call after the upload
+// has been saved.
+func (u *Upload) Discard() {
+	u.f.Close()
+	if !u.adopted {
+		os.Remove(u.f.Name())
+	}
+}
+
+// moveTo syncs the upload to disk and renames it to path.
+func (u *Upload) moveTo(path string) error {
+	if err := u.f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := u.f.Sync(); err != nil {
+		return err
+	}
+	if err := u.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(u.f.Name(), path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Version describes an archived revision of an entry's HTML. Each revision
+// has a version.json in {id}/versions/{revision}/ and its content in the
+// object store; assets are not versioned.
+type Version struct {
+	Revision   int       `json:"revision"`
+	Filename   string    `json:"filename"`
+	ReceivedAt time.Time `json:"received_at"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	Encrypted  bool      `json:"encrypted,omitempty"`
+}
+
+// revision returns the entry's revision number. Entries stored before
+// history was kept have no revision and count as the first.
+func (e *FileEntry) revision() int {
+	if e.Revision == 0 {
+		return 1
+	}
+	return e.Revision
+}
+
+func (s *Store) versionsDir(id string) string {
+	return filepath.Join(s.baseDir, id, "versions")
+}
+
+// archive records the entry's current HTML as a revision in its versions
+// directory.
+func (s *Store) archive(entry *FileEntry) error {
+	if s.keepVersions <= 0 {
+		return nil
+	}
+
+	v := Version{
+		Revision:   entry.revision(),
+		Filename:   entry.Filename,
+		ReceivedAt: entry.ReceivedAt,
+		Size:       entry.Size,
+		SHA256:     entry.SHA256,
+		Encrypted:  entry.Encrypted,
+	}
+
+	dir := filepath.Join(s.versionsDir(entry.ID), strconv.Itoa(v.Revision))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create version dir: %w", err)
+	}
+
+	meta, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal version metadata: %w", err)
+	}
+	// An archive of the same revision may be left over from an update that
+	// failed after archiving; it already holds a reference.
+	_, statErr := os.Stat(filepath.Join(dir, "version.json"))
+	if err := writeFileAtomic(filepath.Join(dir, "version.json"), meta, 0644); err != nil {
+		return fmt.Errorf("write version metadata: %w", err)
+	}
+	if statErr != nil {
+		s.objects.retain(v.SHA256)
+	}
+
+	return nil
+}
+
+// pruneVersions removes the oldest archived revisions beyond the retention
+// count.
+func (s *Store) pruneVersions(id string) error {
+	versions, err := s.Versions(id)
+	if err != nil {
+		return err
+	}
+
+	keep := max(s.keepVersions, 0)
+	for _, v := range versions[min(keep, len(versions)):] {
+		dir := filepath.Join(s.versionsDir(id), strconv.Itoa(v.Revision))
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("remove version %d: %w", v.Revision, err)
+		}
+		s.objects.release(v.SHA256)
+	}
+	return nil
+}
+
+// Versions lists the archived revisions of an entry, newest first.
+func (s *Store) Versions(id string) ([]Version, error) {
+	if !validID.MatchString(id) {
+		return nil, fmt.Errorf("invalid file ID")
+	}
+
+	dirs, err := os.ReadDir(s.versionsDir(id))
+	if os.IsNotExist(err) {
+		return []Version{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read versions dir: %w", err)
+	}
+
+	versions := []Version{}
+	for _, d := range dirs {
+		if _, err := strconv.Atoi(d.Name()); err != nil || !d.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.versionsDir(id), d.Name(), "version.json"))
+		if err != nil {
+			continue
+		}
+		var v Version
+		if err := json.Unmarshal(data, &v); err != nil {
+			continue
+		}
+		versions = append(versions, v)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Revision > versions[j].Revision
+	})
+
+	return versions, nil
+}
+
+// Version returns an archived revision of an entry.
+func (s *Store) Version(id string, revision int) (*Version, error) {
+	versions, err := s.Versions(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.Revision == revision {
+			return &v, nil
+		}
+	}
+	return nil, fmt.Errorf("revision %d not found", revision)
+}
+
+// Restore makes an archived revision current again. The revision being
+// replaced is archived like any other update, so a restore can be undone.
+func (s *Store) Restore(id string, revision int) (*FileEntry, error) {
+	unlock := s.LockEntry(id)
+	defer unlock()
+
+	entry, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := s.Version(id, revision)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.ObjectPath(v.SHA256))
+	if err != nil {
+		return nil, fmt.Errorf("open version: %w", err)
+	}
+	defer f.Close()
+
+	u, err := s.NewUpload()
+	if err != nil {
+		return nil, err
+	}
+	defer u.Discard()
+	if _, err := io.Copy(u, f); err != nil {
+		return nil, fmt.Errorf("copy version: %w", err)
+	}
+
+	restored, _, err := s.update(entry, u, v.Encrypted, time.Now())
+	return restored, err
+}